@@ -1,13 +1,18 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/harsha3330/crun/internal/config"
 	logger "github.com/harsha3330/crun/internal/log"
 	"github.com/harsha3330/crun/internal/pkg"
+	"github.com/harsha3330/crun/internal/registry"
 	"github.com/harsha3330/crun/internal/runtime"
 )
 
@@ -55,6 +60,16 @@ func main() {
 			stater.Success("crun init completed")
 		}
 	case "pull":
+		pullCmd := flag.NewFlagSet("pull", flag.ExitOnError)
+		platform := pullCmd.String("platform", "", "pull for os/arch[/variant] instead of this host")
+		stream := pullCmd.Bool("stream", false, "unpack layers while they download")
+		if err := pullCmd.Parse(os.Args[2:]); err != nil {
+			os.Exit(1)
+		}
+		if pullCmd.NArg() < 1 {
+			stater.Error("usage: crun pull [--platform os/arch[/variant]] [--stream] <image>")
+			os.Exit(1)
+		}
 		logOpts, err := logger.GetLogOptions(cfg.ConfigFilePath)
 		if err != nil {
 			stater.Error("unable to get the logOptions from configfile")
@@ -67,19 +82,88 @@ func main() {
 			os.Exit(1)
 		}
 		stater.Success("Initialized the logger")
-		err = runtime.Pull(cfg, log, stater, os.Args[2])
+		pullOpts := &runtime.PullOptions{Platform: *platform, Stream: *stream}
+		err = runtime.Pull(cfg, log, stater, pullCmd.Arg(0), pullOpts)
 		if err != nil {
 			log.Error(err.Error())
+			stater.Error("pull failed", "error", err)
+			os.Exit(1)
+		}
+	case "push":
+		pushCmd := flag.NewFlagSet("push", flag.ExitOnError)
+		platform := pushCmd.String("platform", "", "push only the image pulled for os/arch[/variant]")
+		chunkMiB := pushCmd.Int64("chunk-size", 0, "upload blobs in chunks of this many MiB (0: one request per blob)")
+		if err := pushCmd.Parse(os.Args[2:]); err != nil {
+			os.Exit(1)
+		}
+		if pushCmd.NArg() < 1 || pushCmd.NArg() > 2 || *chunkMiB < 0 {
+			stater.Error("usage: crun push [--platform os/arch[/variant]] [--chunk-size MiB] <image> [<destination>]")
+			os.Exit(1)
+		}
+		logOpts, err := logger.GetLogOptions(cfg.ConfigFilePath)
+		if err != nil {
+			stater.Error("unable to get the logOptions from configfile", "error", err)
+			os.Exit(1)
+		}
+		log, err := logger.New(logOpts)
+		if err != nil {
+			stater.Error("unable to initalize the logger")
+			os.Exit(1)
+		}
+		pushOpts := &runtime.PushOptions{Platform: *platform, ChunkSize: *chunkMiB << 20}
+		err = runtime.Push(cfg, log, stater, pushCmd.Arg(0), pushCmd.Arg(1), pushOpts)
+		if err != nil {
+			log.Error(err.Error())
+			stater.Error("push failed", "error", err)
+			os.Exit(1)
+		}
+	case "login":
+		loginCmd := flag.NewFlagSet("login", flag.ExitOnError)
+		username := loginCmd.String("u", "", "registry username")
+		password := loginCmd.String("p", "", "registry password or token")
+		passwordStdin := loginCmd.Bool("password-stdin", false, "read the password from stdin")
+		if err := loginCmd.Parse(os.Args[2:]); err != nil {
+			os.Exit(1)
+		}
+		host := "docker.io"
+		if loginCmd.NArg() > 0 {
+			host = loginCmd.Arg(0)
+		}
+		creds, err := promptCredentials(*username, *password, *passwordStdin)
+		if err != nil {
+			stater.Error("unable to read credentials", "error", err)
+			os.Exit(1)
+		}
+		logOpts, err := logger.GetLogOptions(cfg.ConfigFilePath)
+		if err != nil {
+			stater.Error("unable to get the logOptions from configfile", "error", err)
+			os.Exit(1)
+		}
+		log, err := logger.New(logOpts)
+		if err != nil {
+			stater.Error("unable to initalize the logger")
+			os.Exit(1)
+		}
+		if err := runtime.Login(cfg, log, stater, host, creds); err != nil {
+			os.Exit(1)
+		}
+	case "logout":
+		host := "docker.io"
+		if len(os.Args) > 2 {
+			host = os.Args[2]
+		}
+		if err := runtime.Logout(cfg, stater, host); err != nil {
 			os.Exit(1)
 		}
 	case "run":
 		runCmd := flag.NewFlagSet("run", flag.ExitOnError)
 		networkHost := runCmd.Bool("network-host", false, "use host network (access UI at http://localhost)")
+		platform := runCmd.String("platform", "", "run the image pulled for os/arch[/variant]")
 		if err := runCmd.Parse(os.Args[2:]); err != nil {
 			os.Exit(1)
 		}
 		if runCmd.NArg() < 1 {
-			stater.Error("usage: crun run [--network-host] <image>")
+			stater.Error("usage: crun run [--network-host] [--platform os/arch[/variant]] <image>")
 			os.Exit(1)
 		}
 		image := runCmd.Arg(0)
@@ -95,7 +179,7 @@ func main() {
 			os.Exit(1)
 		}
 		stater.Success("Initialized the logger")
-		runOpts := &runtime.RunOptions{HostNetwork: *networkHost}
+		runOpts := &runtime.RunOptions{HostNetwork: *networkHost, Platform: *platform}
 		err = runtime.Run(cfg, log, stater, image, runOpts)
 		if err != nil {
 			log.Error(err.Error())
@@ -111,6 +195,50 @@ func main() {
 			stater.Error("stop failed", "error", err)
 			os.Exit(1)
 		}
+	case "tag":
+		if len(os.Args) != 4 {
+			stater.Error("usage: crun tag <source-image> <target-image>")
+			os.Exit(1)
+		}
+		logOpts, err := logger.GetLogOptions(cfg.ConfigFilePath)
+		if err != nil {
+			stater.Error("unable to get the logOptions from configfile", "error", err)
+			os.Exit(1)
+		}
+		log, err := logger.New(logOpts)
+		if err != nil {
+			stater.Error("unable to initalize the logger")
+			os.Exit(1)
+		}
+		if err := runtime.Tag(cfg, log, stater, os.Args[2], os.Args[3]); err != nil {
+			os.Exit(1)
+		}
+	case "save":
+		saveCmd := flag.NewFlagSet("save", flag.ExitOnError)
+		output := saveCmd.String("o", "", "write the tarball to this file")
+		format := saveCmd.String("format", "oci", `"oci" for an OCI image layout or "docker" for docker load`)
+		platform := saveCmd.String("platform", "", "save only the image pulled for os/arch[/variant]")
+		if err := saveCmd.Parse(os.Args[2:]); err != nil {
+			os.Exit(1)
+		}
+		if *output == "" || saveCmd.NArg() < 1 {
+			stater.Error("usage: crun save -o <file> [--format oci|docker] [--platform os/arch[/variant]] <image>...")
+			os.Exit(1)
+		}
+		logOpts, err := logger.GetLogOptions(cfg.ConfigFilePath)
+		if err != nil {
+			stater.Error("unable to get the logOptions from configfile", "error", err)
+			os.Exit(1)
+		}
+		log, err := logger.New(logOpts)
+		if err != nil {
+			stater.Error("unable to initalize the logger")
+			os.Exit(1)
+		}
+		saveOpts := &runtime.SaveOptions{Format: *format, Platform: *platform}
+		if err := runtime.Save(cfg, log, stater, saveCmd.Args(), *output, saveOpts); err != nil {
+			os.Exit(1)
+		}
 	case "rmi":
 		if len(os.Args) < 3 {
 			stater.Error("usage: crun rmi <image>")
@@ -120,17 +248,70 @@ func main() {
 			stater.Error("rmi failed", "error", err)
 			os.Exit(1)
 		}
+	case "image":
+		if len(os.Args) < 3 {
+			stater.Error("usage: crun image inspect|prune [options]")
+			os.Exit(1)
+		}
+		switch os.Args[2] {
+		case "prune":
+			prune(cfg, stater, "image prune", os.Args[3:], false)
+		case "inspect":
+			inspectCmd := flag.NewFlagSet("image inspect", flag.ExitOnError)
+			platform := inspectCmd.String("platform", "", "inspect the image pulled for os/arch[/variant]")
+			format := inspectCmd.String("format", "", `Go template to print instead of JSON, e.g. '{{.Config.Config.Env}}'`)
+			if err := inspectCmd.Parse(os.Args[3:]); err != nil {
+				os.Exit(1)
+			}
+			if inspectCmd.NArg() < 1 {
+				stater.Error("usage: crun image inspect [--platform os/arch[/variant]] [--format <template>] <image>")
+				os.Exit(1)
+			}
+			details, err := runtime.ImageInspect(cfg, stater, inspectCmd.Arg(0), &runtime.InspectOptions{Platform: *platform})
+			if err != nil {
+				os.Exit(1)
+			}
+			if err := printInspect(details, *format); err != nil {
+				stater.Error("failed to print the image details", "error", err)
+				os.Exit(1)
+			}
+		default:
+			stater.Error("unknown image command", "command", os.Args[2])
+			printUsage()
+			os.Exit(1)
+		}
+	case "system":
+		if len(os.Args) < 3 || os.Args[2] != "prune" {
+			stater.Error("usage: crun system prune [--dry-run]")
+			os.Exit(1)
+		}
+		prune(cfg, stater, "system prune", os.Args[3:], true)
 	case "images":
+		imagesCmd := flag.NewFlagSet("images", flag.ExitOnError)
+		showDigests := imagesCmd.Bool("digests", false, "show image digests")
+		format := imagesCmd.String("format", "", `"json" or a Go template, e.g. '{{.Repository}}:{{.Tag}}'`)
+		var filters stringList
+		imagesCmd.Var(&filters, "filter", "reference=<pattern>, dangling=true|false, before=<image> or since=<image> (repeatable, comma-separated)")
+		if err := imagesCmd.Parse(os.Args[2:]); err != nil {
+			os.Exit(1)
+		}
+		filter, err := runtime.ParseImageFilters(filters)
+		if err != nil {
+			stater.Error(err.Error())
+			os.Exit(1)
+		}
 		list, err := runtime.ImageList(cfg, stater)
 		if err != nil {
 			os.Exit(1)
 		}
-		if len(list) == 0 {
-			fmt.Println("(no images)")
-			break
+		selected, err := filter.Select(list)
+		if err != nil {
+			stater.Error(err.Error())
+			os.Exit(1)
 		}
-		for _, img := range list {
-			fmt.Println(img)
+		if err := printImages(selected, *format, *showDigests); err != nil {
+			stater.Error("failed to print images", "error", err)
+			os.Exit(1)
 		}
 	case "ps":
 		list, err := runtime.ContainerList(cfg, stater)
@@ -157,13 +338,230 @@ func printUsage() {
 	fmt.Println("")
 	fmt.Println("Commands:")
 	fmt.Println("  init              Initialize crun (run once)")
-	fmt.Println("  pull <image>      Pull image from registry (e.g. nginx:1-alpine-perl)")
+	fmt.Println("  pull [options] <image>  Pull image from registry (e.g. nginx:1-alpine-perl, nginx@sha256:...)")
+	fmt.Println("    --platform <os/arch[/variant]>  Pull for another platform (default: this host)")
+	fmt.Println("    --stream  Unpack layers while they download")
+	fmt.Println("  push [options] <image> [<destination>]  Push a pulled image, optionally under another name")
+	fmt.Println("    --platform <os/arch[/variant]>  Push only the image pulled for that platform")
+	fmt.Println("    --chunk-size <MiB>  Upload blobs in chunks (default: one request per blob)")
 	fmt.Println("  run [options] <image>   Run container (detached)")
 	fmt.Println("    --network-host  Use host network (access at http://localhost)")
+	fmt.Println("    --platform <os/arch[/variant]>  Run the image pulled for that platform")
 	fmt.Println("  stop <container-id>   Stop container and remove its filesystem")
-	fmt.Println("  rmi <image>       Remove a pulled image")
-	fmt.Println("  images            List pulled images")
+	fmt.Println("  tag <source-image> <target-image>  Give a pulled image another name")
+	fmt.Println("  save -o <file> [options] <image>...  Write pulled images to a tarball")
+	fmt.Println("    --format <oci|docker>  OCI image layout (default) or a docker load archive")
+	fmt.Println("    --platform <os/arch[/variant]>  Save only the image pulled for that platform")
+	fmt.Println("  rmi <image>       Remove a pulled image (only the tag if other tags share it)")
+	fmt.Println("  image inspect [options] <image>  Show an image's config, layers and pull details as JSON")
+	fmt.Println("    --platform <os/arch[/variant]>  Inspect the image pulled for that platform")
+	fmt.Println("    --format <template>  Print a Go template instead, e.g. '{{.Config.Config.Env}}'")
+	fmt.Println("  image prune [--dry-run]  Remove dangling images and unreferenced blobs and layers")
+	fmt.Println("  system prune [--dry-run]  Also remove stopped containers and what only they used")
+	fmt.Println("  images [options]  List pulled images")
+	fmt.Println("    --digests  Show manifest digests")
+	fmt.Println("    --format <json|template>  Print JSON lines or a Go template per image")
+	fmt.Println("    --filter <key=value>  reference=<pattern>, dangling=true|false")
 	fmt.Println("  ps               List running containers")
+	fmt.Println("  login [options] [registry]  Log in to a registry (default docker.io)")
+	fmt.Println("    -u <user>       Username")
+	fmt.Println("    -p <password>   Password or token")
+	fmt.Println("    --password-stdin  Read the password from stdin")
+	fmt.Println("  logout [registry]  Remove stored credentials for a registry")
 	fmt.Println("")
 	fmt.Println("Docs: see readme.md and docs/usage.md")
 }
+
+// promptCredentials fills in whatever was not given on the command line,
+// prompting on the terminal (the password without echo).
+func promptCredentials(username, password string, passwordStdin bool) (registry.Credentials, error) {
+	if passwordStdin {
+		if password != "" {
+			return registry.Credentials{}, fmt.Errorf("--password-stdin and -p are mutually exclusive")
+		}
+		if username == "" {
+			return registry.Credentials{}, fmt.Errorf("--password-stdin requires -u")
+		}
+		p, err := pkg.ReadLine(os.Stdin)
+		if err != nil {
+			return registry.Credentials{}, err
+		}
+		password = p
+	}
+	if username == "" {
+		fmt.Print("Username: ")
+		u, err := pkg.ReadLine(os.Stdin)
+		if err != nil {
+			return registry.Credentials{}, err
+		}
+		username = strings.TrimSpace(u)
+	}
+	if password == "" {
+		fmt.Print("Password: ")
+		p, err := pkg.ReadPassword(os.Stdin)
+		fmt.Println()
+		if err != nil {
+			return registry.Credentials{}, err
+		}
+		password = p
+	}
+	return registry.Credentials{Username: username, Password: password}, nil
+}
+
+// stringList collects the values of a flag given more than once.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// printImages prints images as a table, as JSON lines for format "json", or
+// through format as a Go template.
+func printImages(images []runtime.ImageInfo, format string, showDigests bool) error {
+	switch format {
+	case "":
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		for _, img := range images {
+			if err := enc.Encode(img); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		tmpl, err := parseFormat(format)
+		if err != nil {
+			return err
+		}
+		for _, img := range images {
+			if err := tmpl.Execute(os.Stdout, img); err != nil {
+				return err
+			}
+			fmt.Println()
+		}
+		return nil
+	}
+	if len(images) == 0 {
+		fmt.Println("(no images)")
+		return nil
+	}
+	digestCol := ""
+	if showDigests {
+		digestCol = fmt.Sprintf(" %-71s", "DIGEST")
+	}
+	fmt.Printf("%-40s %-20s%s %-12s %-16s %-14s %-10s %s\n", "REPOSITORY", "TAG", digestCol, "IMAGE ID", "PLATFORM", "CREATED", "SIZE", "UNPACKED")
+	for _, img := range images {
+		tag := img.Tag
+		if tag == "" {
+			tag = "<none>"
+		}
+		if showDigests {
+			digestCol = fmt.Sprintf(" %-71s", img.Digest)
+		}
+		fmt.Printf("%-40s %-20s%s %-12s %-16s %-14s %-10s %s\n", img.Repository, tag, digestCol, img.ShortID(), img.Platform,
+			humanSince(img.Created), logger.FormatBytes(img.Size), logger.FormatBytes(img.UnpackedSize))
+	}
+	return nil
+}
+
+// parseFormat parses a --format template. Besides the built-in functions
+// it has json, which formats a value as JSON: '{{json .Config.Config.Labels}}'.
+func parseFormat(format string) (*template.Template, error) {
+	tmpl, err := template.New("format").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --format template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// printInspect prints details as indented JSON, or through format as a Go
+// template.
+func printInspect(details *runtime.ImageDetails, format string) error {
+	if format == "" {
+		data, err := json.MarshalIndent(details, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	tmpl, err := parseFormat(format)
+	if err != nil {
+		return err
+	}
+	if err := tmpl.Execute(os.Stdout, details); err != nil {
+		return err
+	}
+	fmt.Println()
+	return nil
+}
+
+// prune runs crun image prune or, with containers set, crun system prune,
+// and prints what it removed.
+func prune(cfg config.Config, stater logger.Console, name string, args []string, containers bool) {
+	pruneCmd := flag.NewFlagSet(name, flag.ExitOnError)
+	dryRun := pruneCmd.Bool("dry-run", false, "only report what would be removed")
+	if err := pruneCmd.Parse(args); err != nil {
+		os.Exit(1)
+	}
+	logOpts, err := logger.GetLogOptions(cfg.ConfigFilePath)
+	if err != nil {
+		stater.Error("unable to get the logOptions from configfile", "error", err)
+		os.Exit(1)
+	}
+	log, err := logger.New(logOpts)
+	if err != nil {
+		stater.Error("unable to initalize the logger")
+		os.Exit(1)
+	}
+	report, err := runtime.Prune(cfg, log, stater, &runtime.PruneOptions{DryRun: *dryRun, Containers: containers})
+	if err != nil {
+		stater.Error(name+" failed", "error", err)
+		os.Exit(1)
+	}
+	verb, total := "removed", "reclaimed"
+	if *dryRun {
+		verb, total = "would remove", "would reclaim"
+	}
+	for _, item := range report.Items {
+		fmt.Printf("%s %s %s (%s)\n", verb, item.Kind, item.Name, logger.FormatBytes(item.Size))
+	}
+	fmt.Printf("%s %s\n", total, logger.FormatBytes(report.Reclaimed))
+}
+
+// humanSince says how long ago t was, roughly: "3 days ago".
+func humanSince(t time.Time) string {
+	if t.IsZero() {
+		return "N/A"
+	}
+	d := time.Since(t)
+	unit := func(n int, name string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s ago", name)
+		}
+		return fmt.Sprintf("%d %ss ago", n, name)
+	}
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return unit(int(d.Minutes()), "minute")
+	case d < 24*time.Hour:
+		return unit(int(d.Hours()), "hour")
+	case d < 14*24*time.Hour:
+		return unit(int(d.Hours()/24), "day")
+	case d < 60*24*time.Hour:
+		return unit(int(d.Hours()/24/7), "week")
+	case d < 365*24*time.Hour:
+		return unit(int(d.Hours()/24/30), "month")
+	}
+	return unit(int(d.Hours()/24/365), "year")
+}
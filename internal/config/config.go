@@ -15,6 +15,23 @@ type Config struct {
 	ConfigFilePath string
 	LogLevel       logger.LogLevel
 	LogFormat      logger.LogFormat
+	Registries     map[string]RegistryConfig
+}
+
+// RegistryConfig holds per-registry settings, keyed by the registry host as
+// it appears in image references (e.g. "docker.io", "ghcr.io").
+type RegistryConfig struct {
+	// Mirrors are tried in order before the registry itself.
+	Mirrors []Mirror
+}
+
+// Mirror is an alternative endpoint serving the same repositories as its
+// upstream registry, such as a pull-through cache.
+type Mirror struct {
+	Endpoint   string // host[:port]
+	Insecure   bool   `toml:",omitempty"` // speak plain http
+	SkipVerify bool   `toml:",omitempty"` // accept any TLS certificate
+	CAFile     string `toml:",omitempty"` // extra CA bundle for the TLS certificate
 }
 
 func getRealUserHome() string {
@@ -41,6 +58,7 @@ func Default() Config {
 		ConfigFilePath: filepath.Join(home, ".crun", "config.toml"),
 		LogLevel:       logger.LevelInfo,
 		LogFormat:      logger.JSONLogFormat,
+		Registries:     map[string]RegistryConfig{},
 	}
 }
 
@@ -0,0 +1,244 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harsha3330/crun/internal/pkg"
+)
+
+const (
+	ttyRefresh    = 150 * time.Millisecond
+	plainInterval = 5 * time.Second
+	barWidth      = 20
+)
+
+// ProgressEvent reports how far one item, such as a blob download or a
+// layer extraction, has got. Events for the same Action and ID update the
+// same line.
+type ProgressEvent struct {
+	ID      string
+	Action  string // e.g. "downloading", "extracting"
+	Current int64  // bytes done so far, including any resumed bytes
+	Total   int64  // 0 when the size is unknown
+	Done    bool   // the item finished or failed and leaves the display
+}
+
+type progressItem struct {
+	event   ProgressEvent
+	started time.Time
+	base    int64 // bytes already there when the item started
+}
+
+// Progress renders ProgressEvents. On a terminal it redraws one line per
+// active item in place, several times a second, and Console output is
+// printed above those lines. Otherwise it prints the state of every active
+// item every plainInterval. A nil *Progress ignores all events.
+type Progress struct {
+	mu    sync.Mutex
+	out   *os.File
+	tty   bool
+	items map[string]*progressItem
+	order []string
+	drawn int // lines of the live display currently on screen
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+var (
+	activeMu sync.Mutex
+	active   *Progress
+)
+
+// NewProgress starts rendering to out. Call Stop when the work is done.
+func NewProgress(out *os.File) *Progress {
+	p := &Progress{
+		out:   out,
+		tty:   pkg.IsTerminal(out),
+		items: make(map[string]*progressItem),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	interval := plainInterval
+	if p.tty {
+		interval = ttyRefresh
+		activeMu.Lock()
+		active = p
+		activeMu.Unlock()
+	}
+	go p.loop(interval)
+	return p
+}
+
+// Update records ev. It is safe to call from several goroutines.
+func (p *Progress) Update(ev ProgressEvent) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := ev.Action + " " + ev.ID
+	item, ok := p.items[key]
+	if ev.Done {
+		if ok {
+			delete(p.items, key)
+			p.order = slices.DeleteFunc(p.order, func(k string) bool { return k == key })
+		}
+		return
+	}
+	if !ok {
+		item = &progressItem{started: time.Now(), base: ev.Current}
+		p.items[key] = item
+		p.order = append(p.order, key)
+	}
+	if ev.Current < item.base {
+		// the transfer restarted from scratch
+		item.started, item.base = time.Now(), ev.Current
+	}
+	item.event = ev
+}
+
+// Stop clears the live display and stops rendering.
+func (p *Progress) Stop() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	activeMu.Lock()
+	if active == p {
+		active = nil
+	}
+	activeMu.Unlock()
+	p.mu.Lock()
+	p.clear()
+	p.mu.Unlock()
+}
+
+func (p *Progress) loop(interval time.Duration) {
+	defer close(p.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			if p.tty {
+				p.redraw()
+			} else {
+				for _, line := range p.lines() {
+					fmt.Fprintln(p.out, "→", line)
+				}
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// printAbove writes a Console line without tearing the live display.
+func (p *Progress) printAbove(out *os.File, line string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	fmt.Fprintln(out, line)
+	p.redraw()
+}
+
+// clear erases the live display; the cursor ends where it started.
+func (p *Progress) clear() {
+	if p.drawn > 0 {
+		fmt.Fprint(p.out, strings.Repeat("\x1b[1A\x1b[2K", p.drawn))
+		p.drawn = 0
+	}
+}
+
+func (p *Progress) redraw() {
+	width := pkg.TerminalWidth(p.out)
+	var b strings.Builder
+	if p.drawn > 0 {
+		b.WriteString(strings.Repeat("\x1b[1A\x1b[2K", p.drawn))
+	}
+	lines := p.lines()
+	for _, line := range lines {
+		// a wrapped line would throw off the cursor arithmetic
+		if width > 0 && len(line) >= width {
+			line = line[:width-1]
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	fmt.Fprint(p.out, b.String())
+	p.drawn = len(lines)
+}
+
+func (p *Progress) lines() []string {
+	now := time.Now()
+	lines := make([]string, 0, len(p.order))
+	for _, key := range p.order {
+		lines = append(lines, p.items[key].format(now, p.tty))
+	}
+	return lines
+}
+
+func (it *progressItem) format(now time.Time, bar bool) string {
+	ev := it.event
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-12s %-11s", shortID(ev.ID), ev.Action)
+	if bar && ev.Total > 0 {
+		filled := int(min(ev.Current, ev.Total) * barWidth / ev.Total)
+		fmt.Fprintf(&b, " [%s%s]", strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled))
+	}
+	if ev.Total > 0 {
+		fmt.Fprintf(&b, " %s / %s", FormatBytes(ev.Current), FormatBytes(ev.Total))
+	} else {
+		fmt.Fprintf(&b, " %s", FormatBytes(ev.Current))
+	}
+	elapsed := now.Sub(it.started).Seconds()
+	if elapsed < 0.5 {
+		return b.String()
+	}
+	rate := float64(ev.Current-it.base) / elapsed
+	fmt.Fprintf(&b, "  %s/s", FormatBytes(int64(rate)))
+	if ev.Total > 0 && rate > 0 {
+		eta := time.Duration(float64(ev.Total-ev.Current) / rate * float64(time.Second))
+		fmt.Fprintf(&b, "  ETA %s", eta.Round(time.Second))
+	}
+	return b.String()
+}
+
+// shortID turns "sha256:<hex>" into the 12 hex digits docker shows.
+func shortID(id string) string {
+	if _, hex, ok := strings.Cut(id, ":"); ok {
+		id = hex
+	}
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return id
+}
+
+// FormatBytes formats n in binary units, e.g. "1.4 MiB".
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func activeProgress() *Progress {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	return active
+}
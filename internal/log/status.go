@@ -16,7 +16,7 @@ func (c Console) Error(msg string, args ...any)   { c.print(os.Stderr, "✖", ms
 
 func (Console) print(out *os.File, prefix, msg string, args ...any) {
 	if len(args) == 0 {
-		fmt.Fprintln(out, prefix, msg)
+		emit(out, prefix+" "+msg)
 		return
 	}
 
@@ -33,5 +33,14 @@ func (Console) print(out *os.File, prefix, msg string, args ...any) {
 		}
 	}
 
-	fmt.Fprintln(out, prefix, b.String())
+	emit(out, prefix+" "+b.String())
+}
+
+// emit prints line, above the live progress display if one is showing.
+func emit(out *os.File, line string) {
+	if p := activeProgress(); p != nil {
+		p.printAbove(out, line)
+		return
+	}
+	fmt.Fprintln(out, line)
 }
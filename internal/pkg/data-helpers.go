@@ -1,13 +1,71 @@
 package pkg
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
+// Media types of the manifest documents a registry may serve for a tag.
+const (
+	MediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// IsIndexMediaType reports whether mediaType is a multi-platform index.
+func IsIndexMediaType(mediaType string) bool {
+	return mediaType == MediaTypeOCIIndex || mediaType == MediaTypeDockerManifestList
+}
+
+// IsManifestMediaType reports whether mediaType is a single image manifest.
+func IsManifestMediaType(mediaType string) bool {
+	return mediaType == MediaTypeOCIManifest || mediaType == MediaTypeDockerManifest
+}
+
+// ManifestMediaType works out what kind of document data is, from the
+// response Content-Type or else the document's own mediaType field.
+// Documents with neither (allowed by the OCI spec) are told apart by
+// whether they list manifests or layers.
+func ManifestMediaType(contentType string, data []byte) (string, error) {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	contentType = strings.TrimSpace(contentType)
+	if IsIndexMediaType(contentType) || IsManifestMediaType(contentType) {
+		return contentType, nil
+	}
+	var doc struct {
+		SchemaVersion int               `json:"schemaVersion"`
+		MediaType     string            `json:"mediaType"`
+		Manifests     []json.RawMessage `json:"manifests"`
+		Config        json.RawMessage   `json:"config"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return "", fmt.Errorf("decode manifest: %w", err)
+	}
+	switch {
+	case IsIndexMediaType(doc.MediaType) || IsManifestMediaType(doc.MediaType):
+		return doc.MediaType, nil
+	case doc.SchemaVersion == 1:
+		return "", fmt.Errorf("docker schema 1 manifests are not supported")
+	case doc.MediaType == "" && doc.Manifests != nil:
+		return MediaTypeOCIIndex, nil
+	case doc.MediaType == "" && doc.Config != nil:
+		return MediaTypeOCIManifest, nil
+	}
+	if doc.MediaType == "" {
+		doc.MediaType = contentType
+	}
+	return "", fmt.Errorf("unsupported manifest media type %q", doc.MediaType)
+}
+
 type OCIIndex struct {
 	SchemaVersion int    `json:"schemaVersion"`
 	MediaType     string `json:"mediaType"`
@@ -20,6 +78,7 @@ type OCIIndex struct {
 			OS           string `json:"os"`
 			Variant      string `json:"variant,omitempty"`
 		} `json:"platform"`
+		Annotations map[string]string `json:"annotations,omitempty"`
 	} `json:"manifests"`
 }
 
@@ -37,17 +96,52 @@ type OCIManifest struct {
 }
 
 type OCIImageConfig struct {
+	Created      string `json:"created,omitempty"`
+	Author       string `json:"author,omitempty"`
 	Architecture string `json:"architecture"`
 	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
 
 	Config struct {
-		Env          []string       `json:"Env"`
-		Entrypoint   []string       `json:"Entrypoint"`
-		Cmd          []string       `json:"Cmd"`
-		WorkingDir   string         `json:"WorkingDir"`
-		ExposedPorts map[string]any `json:"ExposedPorts"`
-		StopSignal   string         `json:"StopSignal"`
+		User         string            `json:"User,omitempty"`
+		Env          []string          `json:"Env"`
+		Entrypoint   []string          `json:"Entrypoint"`
+		Cmd          []string          `json:"Cmd"`
+		WorkingDir   string            `json:"WorkingDir"`
+		ExposedPorts map[string]any    `json:"ExposedPorts"`
+		Volumes      map[string]any    `json:"Volumes,omitempty"`
+		Labels       map[string]string `json:"Labels,omitempty"`
+		StopSignal   string            `json:"StopSignal"`
+		// Healthcheck is a Docker extension to the OCI config.
+		Healthcheck *Healthcheck `json:"Healthcheck,omitempty"`
 	} `json:"config"`
+
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+
+	History []History `json:"history,omitempty"`
+}
+
+// Healthcheck is how the image's author says to check the container is
+// working. The durations are in nanoseconds, as in the config JSON.
+type Healthcheck struct {
+	Test        []string      `json:"Test,omitempty"`
+	Interval    time.Duration `json:"Interval,omitempty"`
+	Timeout     time.Duration `json:"Timeout,omitempty"`
+	StartPeriod time.Duration `json:"StartPeriod,omitempty"`
+	Retries     int           `json:"Retries,omitempty"`
+}
+
+// History is one step of the image build. Steps with EmptyLayer set, such
+// as ENV or CMD, did not add a layer.
+type History struct {
+	Created    string `json:"created,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	Author     string `json:"author,omitempty"`
+	Comment    string `json:"comment,omitempty"`
+	EmptyLayer bool   `json:"empty_layer,omitempty"`
 }
 
 func DecodeImageManifest(data []byte) (*OCIManifest, error) {
@@ -101,13 +195,88 @@ func DecodeIndex(data []byte) (*OCIIndex, error) {
 	return &idx, nil
 }
 
-func SelectPlatformManifest(idx *OCIIndex, os, arch string) (string, error) {
+// SelectPlatformManifest picks the manifest in idx that best suits want,
+// preferring an exact variant over older compatible ones, and returns its
+// digest and platform. Attestation manifests are never selected.
+func SelectPlatformManifest(idx *OCIIndex, want Platform) (string, Platform, error) {
+	want = NormalizePlatform(want)
+	var candidates []Platform
+	var digests, available []string
 	for _, m := range idx.Manifests {
-		if m.Platform.OS == os && m.Platform.Architecture == arch {
-			return m.Digest, nil
+		// buildkit stores provenance and SBOMs as unknown/unknown entries
+		if m.Platform.OS == "unknown" || m.Platform.Architecture == "unknown" ||
+			m.Annotations["vnd.docker.reference.type"] == "attestation-manifest" {
+			continue
 		}
+		have := NormalizePlatform(Platform{OS: m.Platform.OS, Arch: m.Platform.Architecture, Variant: m.Platform.Variant})
+		candidates = append(candidates, have)
+		digests = append(digests, m.Digest)
+		available = append(available, have.String())
+	}
+	best := BestPlatform(want, candidates)
+	if best < 0 {
+		return "", Platform{}, fmt.Errorf("no manifest for %s (available: %s)", want, strings.Join(available, ", "))
+	}
+	return digests[best], candidates[best], nil
+}
+
+// ComputeDigest returns the sha256 digest of data in "sha256:<hex>" form.
+func ComputeDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// VerifyDigest checks that data hashes to the expected digest.
+func VerifyDigest(data []byte, expected string) error {
+	if got := ComputeDigest(data); got != expected {
+		return fmt.Errorf("digest mismatch: expected %s, got %s", expected, got)
+	}
+	return nil
+}
+
+// DigestVerifier hashes the bytes written to it so content can be checked
+// against its expected digest while it streams.
+type DigestVerifier struct {
+	expected string
+	h        hash.Hash
+	n        int64
+}
+
+// NewDigestVerifier returns a verifier for a "sha256:<hex>" digest.
+func NewDigestVerifier(expected string) (*DigestVerifier, error) {
+	if err := ValidateDigest(expected); err != nil {
+		return nil, err
+	}
+	return &DigestVerifier{expected: expected, h: sha256.New()}, nil
+}
+
+func (v *DigestVerifier) Write(p []byte) (int, error) {
+	n, err := v.h.Write(p)
+	v.n += int64(n)
+	return n, err
+}
+
+// Size returns the number of bytes hashed so far.
+func (v *DigestVerifier) Size() int64 {
+	return v.n
+}
+
+// Verify checks the bytes written so far against the expected digest.
+func (v *DigestVerifier) Verify() error {
+	if got := "sha256:" + hex.EncodeToString(v.h.Sum(nil)); got != v.expected {
+		return fmt.Errorf("digest mismatch: expected %s, got %s", v.expected, got)
+	}
+	return nil
+}
+
+// ValidateDigest checks that d is a well-formed sha256 digest, which also
+// makes its hex part safe to use as a file name in the blob store.
+func ValidateDigest(d string) error {
+	hexPart, ok := strings.CutPrefix(d, "sha256:")
+	if !ok || len(hexPart) != 64 || strings.Trim(hexPart, "0123456789abcdef") != "" {
+		return fmt.Errorf("invalid digest %q", d)
 	}
-	return "", fmt.Errorf("no manifest for %s/%s", os, arch)
+	return nil
 }
 
 func SaveFile(path string, data []byte) error {
@@ -1,8 +1,6 @@
 package pkg
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"fmt"
 	"io"
 	"os"
@@ -71,79 +69,6 @@ func EnsureFile(path string) error {
 	return file.Close()
 }
 
-func EnsureLayerExtracted(blobDir, layerDir, digest string) (string, error) {
-	fsPath := filepath.Join(layerDir, digest)
-	if _, err := os.Stat(fsPath); err == nil {
-		return fsPath, nil
-	}
-	blobPath := filepath.Join(blobDir, digest)
-	if err := os.MkdirAll(fsPath, 0755); err != nil {
-		return "", err
-	}
-	if err := extractTarGz(blobPath, fsPath); err != nil {
-		return "", err
-	}
-	return fsPath, nil
-}
-
-func extractTarGz(tarPath, dest string) error {
-	f, err := os.Open(tarPath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	gzr, err := gzip.NewReader(f)
-	if err != nil {
-		return err
-	}
-	defer gzr.Close()
-
-	tr := tar.NewReader(gzr)
-
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		target := filepath.Join(dest, hdr.Name)
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)); err != nil {
-				return err
-			}
-		case tar.TypeReg:
-			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-				return err
-			}
-			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode))
-			if err != nil {
-				return err
-			}
-			if _, err := io.Copy(out, tr); err != nil {
-				out.Close()
-				return err
-			}
-			out.Close()
-			if err := os.Chmod(target, os.FileMode(hdr.Mode)); err != nil {
-				return err
-			}
-		case tar.TypeSymlink:
-			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-				return err
-			}
-			if err := os.Symlink(hdr.Linkname, target); err != nil && !os.IsExist(err) {
-				return err
-			}
-		}
-	}
-
-	return nil
-}
-
 func mkdev(major, minor int) int {
 	return (major << 8) | minor
 }
@@ -187,3 +112,27 @@ func SetupDev(rootfs string) error {
 
 	return nil
 }
+
+// NewProgressReader returns a reader that calls fn with start plus the
+// number of bytes read so far after every read. A nil fn returns r as is.
+func NewProgressReader(r io.Reader, start int64, fn func(int64)) io.Reader {
+	if fn == nil {
+		return r
+	}
+	return &progressReader{r: r, n: start, fn: fn}
+}
+
+type progressReader struct {
+	r  io.Reader
+	n  int64
+	fn func(int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.n += int64(n)
+		p.fn(p.n)
+	}
+	return n, err
+}
@@ -0,0 +1,605 @@
+package pkg
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sys/unix"
+)
+
+// Compression is how a layer tarball is compressed.
+type Compression string
+
+const (
+	Uncompressed Compression = "none"
+	Gzip         Compression = "gzip"
+	Zstd         Compression = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// LayerCompression returns the compression a layer media type declares,
+// going by its suffix so that the OCI, docker and nondistributable layer
+// types are all covered. ok is false for types without a known suffix.
+func LayerCompression(mediaType string) (Compression, bool) {
+	mediaType, _, _ = strings.Cut(mediaType, ";")
+	switch {
+	case strings.HasSuffix(mediaType, "+zstd"):
+		return Zstd, true
+	case strings.HasSuffix(mediaType, "+gzip"), strings.HasSuffix(mediaType, ".tar.gzip"):
+		return Gzip, true
+	case strings.HasSuffix(mediaType, ".tar"):
+		return Uncompressed, true
+	}
+	return "", false
+}
+
+// DetectCompression guesses the compression of a blob from its first bytes.
+// Anything that is neither gzip nor zstd is taken to be a plain tar.
+func DetectCompression(head []byte) Compression {
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return Gzip
+	case bytes.HasPrefix(head, zstdMagic):
+		return Zstd
+	}
+	return Uncompressed
+}
+
+// NewLayerReader returns the uncompressed tar stream of a layer blob. The
+// compression is sniffed from the blob's first bytes, which win over what
+// mediaType declares: images with mislabelled layers, such as gzip blobs
+// pushed as plain tars, are common and docker unpacks them the same way.
+// mediaType only serves to explain a blob that fails to decompress.
+func NewLayerReader(r io.Reader, mediaType string) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	compression := DetectCompression(head)
+	declared := ""
+	if c, ok := LayerCompression(mediaType); ok && c != compression {
+		declared = fmt.Sprintf(" (media type %s declares %s)", mediaType, c)
+	}
+	switch compression {
+	case Gzip:
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("open gzip layer%s: %w", declared, err)
+		}
+		return gzr, nil
+	case Zstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("open zstd layer%s: %w", declared, err)
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return io.NopCloser(br), nil
+}
+
+// ExtractOptions configure how a layer blob is unpacked.
+type ExtractOptions struct {
+	// MediaType is the layer's descriptor media type. The compression is
+	// detected from the blob itself; see NewLayerReader.
+	MediaType string
+
+	// Progress, if set, is called with the number of compressed bytes read
+	// so far.
+	Progress func(read int64)
+
+	// OnReject, if set, is called for every entry that is skipped because
+	// it would be written outside the layer directory.
+	OnReject func(name string, reason error)
+}
+
+// EnsureLayerExtracted unpacks blobs/<digest> into layers/<digest> unless
+// that is already there. The layer is installed with InstallLayer, so a
+// layers/<digest> that exists is always complete.
+func EnsureLayerExtracted(blobDir, layerDir, digest string, opts *ExtractOptions) (string, error) {
+	if opts == nil {
+		opts = &ExtractOptions{}
+	}
+	fsPath := filepath.Join(layerDir, digest)
+	if _, err := os.Stat(fsPath); err == nil {
+		return fsPath, nil
+	}
+	blobPath := filepath.Join(blobDir, digest)
+	return InstallLayer(layerDir, digest, func(dir string) error {
+		return extractLayer(blobPath, dir, opts)
+	})
+}
+
+// layerTempInfix is part of the name of the directories layers are
+// unpacked into, followed by the pid of the process unpacking them.
+const layerTempInfix = ".extracting-"
+
+// InstallLayer fills layerDir/<digest> without ever leaving a partial layer
+// there: unpack writes into a temporary sibling directory, which is renamed
+// into place once unpack succeeds and removed otherwise. A layer another
+// pull installed in the meantime is kept.
+func InstallLayer(layerDir, digest string, unpack func(dir string) error) (string, error) {
+	fsPath := filepath.Join(layerDir, digest)
+	tmp, err := os.MkdirTemp(layerDir, fmt.Sprintf(".%s%s%d-", digest, layerTempInfix, os.Getpid()))
+	if err != nil {
+		return "", err
+	}
+	// MkdirTemp makes it 0700, which would hide the rootfs from containers
+	// that do not run as root
+	if err := os.Chmod(tmp, 0755); err != nil {
+		_ = RemoveLayer(tmp)
+		return "", err
+	}
+	if err := unpack(tmp); err != nil {
+		_ = RemoveLayer(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, fsPath); err != nil {
+		_ = RemoveLayer(tmp)
+		if _, serr := os.Stat(fsPath); serr == nil {
+			return fsPath, nil
+		}
+		return "", err
+	}
+	return fsPath, nil
+}
+
+// CleanLayerTemps removes the temporary directories in layerDir left by
+// unpacking that was killed before it finished, and returns how many it
+// removed. Directories of processes that are still running are left alone.
+func CleanLayerTemps(layerDir string) (int, error) {
+	entries, err := os.ReadDir(layerDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	removed := 0
+	for _, e := range entries {
+		_, owner, ok := strings.Cut(e.Name(), layerTempInfix)
+		if !ok || !strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		pidStr, _, _ := strings.Cut(owner, "-")
+		if pid, err := strconv.Atoi(pidStr); err == nil && processAlive(pid) {
+			continue
+		}
+		if err := RemoveLayer(filepath.Join(layerDir, e.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// processAlive reports whether a process with the given pid exists.
+func processAlive(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || err == unix.EPERM
+}
+
+// RemoveLayer deletes an extracted layer directory. Directories the image
+// made read-only are made writable first, so that a layer extracted without
+// root can be removed without it too.
+func RemoveLayer(path string) error {
+	_ = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		// called before the directory is read, so unreadable ones open up
+		if err == nil && d.IsDir() {
+			_ = os.Chmod(p, 0700)
+		}
+		return nil
+	})
+	return os.RemoveAll(path)
+}
+
+// ErrUnsafePath is the reason given to OnReject for entries that would be
+// written outside the layer directory.
+var ErrUnsafePath = errors.New("path escapes the layer")
+
+// resolveInLayer returns where the entry name goes inside dest, creating
+// missing parent directories. Names that are absolute or climb out of dest
+// are rejected, and so are names below a symlink: a layer could otherwise
+// add a symlink to any host directory and then write through it. Only the
+// final component may be a symlink, which is replaced rather than followed.
+func resolveInLayer(dest, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("%w: absolute path", ErrUnsafePath)
+	}
+	clean := filepath.Clean(name)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%w: climbs out of the layer root", ErrUnsafePath)
+	}
+	if clean == "." {
+		return dest, nil
+	}
+	dir := dest
+	for _, part := range strings.Split(filepath.Dir(clean), "/") {
+		if part == "." {
+			continue
+		}
+		dir = filepath.Join(dir, part)
+		fi, err := os.Lstat(dir)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return "", err
+			}
+		case err != nil:
+			return "", err
+		case fi.Mode()&os.ModeSymlink != 0:
+			return "", fmt.Errorf("%w: parent %s is a symlink", ErrUnsafePath, strings.TrimPrefix(dir, dest+"/"))
+		case !fi.IsDir():
+			return "", fmt.Errorf("parent %s is not a directory", strings.TrimPrefix(dir, dest+"/"))
+		}
+	}
+	return filepath.Join(dest, clean), nil
+}
+
+// paxXattrPrefix marks the PAX records that carry extended attributes.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// extractLayer unpacks the layer blob at blobPath into dest.
+func extractLayer(blobPath, dest string, opts *ExtractOptions) error {
+	f, err := os.Open(blobPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return ExtractLayer(f, dest, opts)
+}
+
+// ExtractLayer unpacks the layer blob read from r into dest with
+// everything images rely on: hardlinks, device nodes, FIFOs, modes
+// including setuid bits, ownership, xattrs and modification times. Only
+// root can give files away or set xattrs outside the user.* namespace, so
+// for other users files keep their owner and those xattrs are left out.
+//
+// It stops at the end of the tar archive; anything r holds after that,
+// such as compression trailers, is left unread.
+func ExtractLayer(r io.Reader, dest string, opts *ExtractOptions) error {
+	if opts == nil {
+		opts = &ExtractOptions{}
+	}
+	dest = filepath.Clean(dest)
+	layer, err := NewLayerReader(NewProgressReader(r, 0, opts.Progress), opts.MediaType)
+	if err != nil {
+		return err
+	}
+	defer layer.Close()
+
+	tr := tar.NewReader(layer)
+	root := os.Geteuid() == 0
+	// directories get their metadata once everything is in them: writing
+	// their contents would change their times, and a read-only mode would
+	// stop it altogether
+	var dirs []dirEntry
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		target, err := resolveInLayer(dest, hdr.Name)
+		if err == nil && target == dest && hdr.Typeflag != tar.TypeDir {
+			err = fmt.Errorf("%w: only a directory can replace the layer root", ErrUnsafePath)
+		}
+		if errors.Is(err, ErrUnsafePath) {
+			if opts.OnReject != nil {
+				opts.OnReject(hdr.Name, err)
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(filepath.Base(target), whiteoutPrefix) {
+			err := extractWhiteout(dest, target)
+			if errors.Is(err, ErrUnsafePath) {
+				if opts.OnReject != nil {
+					opts.OnReject(hdr.Name, err)
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		// an entry replaces whatever an earlier one left at its path; a
+		// symlink left there would otherwise be followed
+		if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+				return err
+			}
+			dirs = append(dirs, dirEntry{path: target, hdr: hdr})
+			continue
+		case tar.TypeReg:
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			source, err := resolveInLayer(dest, hdr.Linkname)
+			if errors.Is(err, ErrUnsafePath) {
+				if opts.OnReject != nil {
+					opts.OnReject(hdr.Name, fmt.Errorf("hardlink to %s: %w", hdr.Linkname, err))
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			// the link shares its inode, and so its metadata, with the
+			// file it points to
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			mode := uint32(hdr.Mode & 07777)
+			switch hdr.Typeflag {
+			case tar.TypeChar:
+				mode |= unix.S_IFCHR
+			case tar.TypeBlock:
+				mode |= unix.S_IFBLK
+			default:
+				mode |= unix.S_IFIFO
+			}
+			dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+			if err := unix.Mknod(target, mode, int(dev)); err != nil {
+				return privilegeError("create device", target, err)
+			}
+		default:
+			// nothing on disk for other entry types, e.g. GNU volume headers
+			continue
+		}
+		if err := applyMetadata(target, hdr, root); err != nil {
+			return err
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := applyDirMetadata(dest, dirs[i].path, dirs[i].hdr, root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirEntry is a directory whose metadata extractLayer applies last.
+type dirEntry struct {
+	path string
+	hdr  *tar.Header
+}
+
+// applyMetadata gives path the owner, mode, xattrs and times recorded in
+// hdr, without following path if it is a symlink. path must just have been
+// resolved with resolveInLayer, so none of its parents is a symlink.
+func applyMetadata(path string, hdr *tar.Header, root bool) error {
+	symlink := hdr.Typeflag == tar.TypeSymlink
+	if root {
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	// after the chown, which clears setuid and setgid bits
+	if !symlink {
+		if err := unix.Chmod(path, uint32(hdr.Mode&07777)); err != nil {
+			return err
+		}
+	}
+	for name, value := range headerXattrs(hdr, root) {
+		if err := unix.Lsetxattr(path, name, []byte(value), 0); err != nil {
+			return fmt.Errorf("set xattr %s on %s: %w", name, path, err)
+		}
+	}
+	if times := headerTimes(hdr); times != nil {
+		return unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW)
+	}
+	return nil
+}
+
+// applyDirMetadata is applyMetadata for the directories ExtractLayer
+// finishes last. By then later entries may have replaced the directory, or
+// any directory above it, with a symlink, so it is reached one component at
+// a time from outside dest without following symlinks, and changed through
+// the open directory. A directory that has been replaced is skipped.
+func applyDirMetadata(dest, path string, hdr *tar.Header, root bool) error {
+	dir, parent, err := openLayerDir(dest, path)
+	if errors.Is(err, unix.ELOOP) || errors.Is(err, unix.ENOTDIR) || errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+	defer unix.Close(parent)
+	if root {
+		if err := unix.Fchown(dir, hdr.Uid, hdr.Gid); err != nil {
+			return fmt.Errorf("chown %s: %w", path, err)
+		}
+	}
+	if err := unix.Fchmod(dir, uint32(hdr.Mode&07777)); err != nil {
+		return fmt.Errorf("chmod %s: %w", path, err)
+	}
+	for name, value := range headerXattrs(hdr, root) {
+		if err := unix.Fsetxattr(dir, name, []byte(value), 0); err != nil {
+			return fmt.Errorf("set xattr %s on %s: %w", name, path, err)
+		}
+	}
+	if times := headerTimes(hdr); times != nil {
+		return unix.UtimesNanoAt(parent, filepath.Base(path), times, unix.AT_SYMLINK_NOFOLLOW)
+	}
+	return nil
+}
+
+// openLayerDir opens the directory path, which is dest or below it, and
+// its parent, walking down from dest's own parent with O_NOFOLLOW on every
+// component. A symlink anywhere on the way fails with ELOOP.
+func openLayerDir(dest, path string) (dir, parent int, err error) {
+	rel, err := filepath.Rel(dest, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return -1, -1, fmt.Errorf("%w: %s", ErrUnsafePath, path)
+	}
+	parts := []string{filepath.Base(dest)}
+	if rel != "." {
+		parts = append(parts, strings.Split(rel, "/")...)
+	}
+	parent, err = unix.Open(filepath.Dir(dest), unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, -1, err
+	}
+	for i, part := range parts {
+		dir, err = unix.Openat(parent, part, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			unix.Close(parent)
+			return -1, -1, fmt.Errorf("open %s: %w", path, err)
+		}
+		if i == len(parts)-1 {
+			break
+		}
+		unix.Close(parent)
+		parent = dir
+	}
+	return dir, parent, nil
+}
+
+// headerXattrs returns the xattrs recorded in hdr that can be set: only
+// root can set those outside the user.* namespace, and the kernel refuses
+// user.* xattrs on symlinks.
+func headerXattrs(hdr *tar.Header, root bool) map[string]string {
+	symlink := hdr.Typeflag == tar.TypeSymlink
+	xattrs := make(map[string]string)
+	for key, value := range hdr.PAXRecords {
+		name, ok := strings.CutPrefix(key, paxXattrPrefix)
+		if !ok {
+			continue
+		}
+		user := strings.HasPrefix(name, "user.")
+		if (!root && !user) || (symlink && user) {
+			continue
+		}
+		xattrs[name] = value
+	}
+	return xattrs
+}
+
+// headerTimes returns the access and modification times recorded in hdr
+// for utimensat, or nil if it has none.
+func headerTimes(hdr *tar.Header) []unix.Timespec {
+	if hdr.ModTime.IsZero() {
+		return nil
+	}
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	return []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(hdr.ModTime.UnixNano())}
+}
+
+// Whiteouts are how a layer tarball records deletions: .wh.<name> removes
+// <name> from the layers below and .wh..wh..opq in a directory hides
+// everything the layers below have in it.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+	opaqueXattr    = "trusted.overlay.opaque"
+)
+
+// extractWhiteout converts the whiteout entry at path, already resolved
+// inside dest, into the form overlayfs understands: a 0/0 character device
+// in place of the deleted entry, or the trusted.overlay.opaque xattr on an
+// opaque directory. Both need root (CAP_MKNOD and CAP_SYS_ADMIN
+// respectively).
+//
+// The name left once .wh. is stripped is checked again: .wh.. would
+// otherwise delete the directory holding the whiteout and .wh... the one
+// above it, which for a whiteout at the top of the layer is every layer in
+// the store.
+func extractWhiteout(dest, path string) error {
+	dir, base := filepath.Split(path)
+	dir = filepath.Clean(dir)
+	if base == whiteoutOpaque {
+		fd, parent, err := openLayerDir(dest, dir)
+		if errors.Is(err, unix.ELOOP) || errors.Is(err, unix.ENOTDIR) {
+			return fmt.Errorf("%w: opaque directory: %v", ErrUnsafePath, err)
+		}
+		if err != nil {
+			return err
+		}
+		defer unix.Close(fd)
+		defer unix.Close(parent)
+		if err := unix.Fsetxattr(fd, opaqueXattr, []byte("y"), 0); err != nil {
+			return privilegeError("mark opaque directory", dir, err)
+		}
+		return nil
+	}
+	name := strings.TrimPrefix(base, whiteoutPrefix)
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("%w: whiteout for %q", ErrUnsafePath, name)
+	}
+	rel, err := filepath.Rel(dest, filepath.Join(dir, name))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsafePath, err)
+	}
+	target, err := resolveInLayer(dest, rel)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(target, dest+string(filepath.Separator)) {
+		return fmt.Errorf("%w: whiteout target %s is not inside the layer", ErrUnsafePath, rel)
+	}
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+	if err := unix.Mknod(target, unix.S_IFCHR, 0); err != nil {
+		return privilegeError("create whiteout", target, err)
+	}
+	return nil
+}
+
+// privilegeError explains the failures to expect when a layer that needs
+// root to extract is pulled without it.
+func privilegeError(op, path string, err error) error {
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+		return fmt.Errorf("%s %s: %w (this layer must be extracted as root, run the command with sudo)", op, path, err)
+	}
+	if errors.Is(err, unix.ENOTSUP) {
+		return fmt.Errorf("%s %s: %w (the filesystem holding the crun root directory must support trusted xattrs)", op, path, err)
+	}
+	return fmt.Errorf("%s %s: %w", op, path, err)
+}
@@ -0,0 +1,517 @@
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sys/unix"
+)
+
+// layerEntry is one tar entry of a test layer.
+type layerEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+	mode     int64
+	uid      int
+}
+
+func dirEntryOf(name string) layerEntry {
+	return layerEntry{name: name, typeflag: tar.TypeDir, mode: 0755}
+}
+
+func fileEntry(name, body string) layerEntry {
+	return layerEntry{name: name, typeflag: tar.TypeReg, body: body, mode: 0644}
+}
+
+func symlinkEntry(name, target string) layerEntry {
+	return layerEntry{name: name, typeflag: tar.TypeSymlink, linkname: target, mode: 0777}
+}
+
+func hardlinkEntry(name, target string) layerEntry {
+	return layerEntry{name: name, typeflag: tar.TypeLink, linkname: target}
+}
+
+func buildLayer(t *testing.T, entries []layerEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     e.mode,
+			Uid:      e.uid,
+			Size:     int64(len(e.body)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// extractTestLayer unpacks entries into layers/test under a fresh store
+// next to a layers/other layer and an outside/ directory, and returns the
+// store root, the layer directory and the names of the rejected entries.
+func extractTestLayer(t *testing.T, entries []layerEntry) (string, string, []string) {
+	t.Helper()
+	return extractTestLayerAt(t, func(string) []layerEntry { return entries })
+}
+
+// extractTestLayerAt is extractTestLayer for entries that name paths in
+// the store root.
+func extractTestLayerAt(t *testing.T, entries func(root string) []layerEntry) (string, string, []string) {
+	t.Helper()
+	root := t.TempDir()
+	for _, dir := range []string{"layers/test", "layers/other", "outside/victim"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"layers/other/keep", "outside/secret"} {
+		if err := os.WriteFile(filepath.Join(root, file), []byte("keep"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dest := filepath.Join(root, "layers", "test")
+	var rejected []string
+	opts := &ExtractOptions{
+		MediaType: "application/vnd.oci.image.layer.v1.tar",
+		OnReject: func(name string, reason error) {
+			if !errors.Is(reason, ErrUnsafePath) {
+				t.Errorf("entry %s rejected with %v, want ErrUnsafePath", name, reason)
+			}
+			rejected = append(rejected, name)
+		},
+	}
+	if err := ExtractLayer(bytes.NewReader(buildLayer(t, entries(root))), dest, opts); err != nil {
+		t.Fatalf("ExtractLayer: %v", err)
+	}
+	return root, dest, rejected
+}
+
+// assertStoreIntact checks that nothing outside the layer was touched.
+func assertStoreIntact(t *testing.T, root string) {
+	t.Helper()
+	for _, file := range []string{"layers/other/keep", "outside/secret"} {
+		data, err := os.ReadFile(filepath.Join(root, file))
+		if err != nil || string(data) != "keep" {
+			t.Errorf("%s was modified: %q, %v", file, data, err)
+		}
+	}
+	for _, dir := range []string{"layers", "layers/test", "outside", "outside/victim"} {
+		fi, err := os.Lstat(filepath.Join(root, dir))
+		if err != nil || !fi.IsDir() {
+			t.Errorf("%s is no longer a directory: %v", dir, err)
+			continue
+		}
+		if perm := fi.Mode().Perm(); perm != 0755 {
+			t.Errorf("%s has mode %v, want 0755", dir, perm)
+		}
+	}
+	var st unix.Stat_t
+	if err := unix.Lstat(filepath.Join(root, "outside", "victim"), &st); err == nil && int(st.Uid) != os.Geteuid() {
+		t.Errorf("outside/victim is owned by %d, want %d", st.Uid, os.Geteuid())
+	}
+	entries, _ := os.ReadDir(filepath.Join(root, "outside"))
+	if len(entries) != 2 {
+		t.Errorf("outside/ has %d entries, want 2", len(entries))
+	}
+}
+
+func TestExtractLayerStaysInside(t *testing.T) {
+	victim := layerEntry{name: "a/victim/", typeflag: tar.TypeDir, mode: 0777, uid: 4242}
+	tests := []struct {
+		name     string
+		entries  func(root string) []layerEntry
+		rejected []string
+	}{
+		{
+			name:     "name that climbs out",
+			entries:  func(string) []layerEntry { return []layerEntry{fileEntry("../../outside/new", "x")} },
+			rejected: []string{"../../outside/new"},
+		},
+		{
+			name:     "name that climbs out after a subdirectory",
+			entries:  func(string) []layerEntry { return []layerEntry{fileEntry("a/../../escape", "x")} },
+			rejected: []string{"a/../../escape"},
+		},
+		{
+			name: "absolute name",
+			entries: func(root string) []layerEntry {
+				return []layerEntry{fileEntry(filepath.Join(root, "outside", "new"), "x")}
+			},
+			rejected: []string{"*"},
+		},
+		{
+			name: "file below a relative symlink",
+			entries: func(string) []layerEntry {
+				return []layerEntry{symlinkEntry("link", "../../outside"), fileEntry("link/new", "x")}
+			},
+			rejected: []string{"link/new"},
+		},
+		{
+			name: "file below an absolute symlink",
+			entries: func(root string) []layerEntry {
+				return []layerEntry{symlinkEntry("link", filepath.Join(root, "outside")), fileEntry("link/secret", "x")}
+			},
+			rejected: []string{"link/secret"},
+		},
+		{
+			name: "directory below a symlink",
+			entries: func(string) []layerEntry {
+				return []layerEntry{symlinkEntry("link", "../../outside"), {name: "link/victim/", typeflag: tar.TypeDir, mode: 0777}}
+			},
+			rejected: []string{"link/victim/"},
+		},
+		{
+			name: "symlink that replaces a directory after the fact",
+			entries: func(string) []layerEntry {
+				return []layerEntry{dirEntryOf("a/"), victim, symlinkEntry("a", "../../outside")}
+			},
+		},
+		{
+			name: "symlink that replaces a directory, then a file below it",
+			entries: func(string) []layerEntry {
+				return []layerEntry{dirEntryOf("a/"), symlinkEntry("a", "../../outside"), fileEntry("a/secret", "x")}
+			},
+			rejected: []string{"a/secret"},
+		},
+		{
+			name: "absolute symlink that replaces a parent directory",
+			entries: func(root string) []layerEntry {
+				return []layerEntry{dirEntryOf("a/"), victim, symlinkEntry("a", filepath.Join(root, "outside"))}
+			},
+		},
+		{
+			name: "file that replaces a symlink",
+			entries: func(string) []layerEntry {
+				return []layerEntry{symlinkEntry("secret", "../../outside/secret"), fileEntry("secret", "x")}
+			},
+		},
+		{
+			name: "hardlink that climbs out",
+			entries: func(string) []layerEntry {
+				return []layerEntry{hardlinkEntry("h", "../../outside/secret")}
+			},
+			rejected: []string{"h"},
+		},
+		{
+			name: "hardlink to an absolute path",
+			entries: func(root string) []layerEntry {
+				return []layerEntry{hardlinkEntry("h", filepath.Join(root, "outside", "secret"))}
+			},
+			rejected: []string{"h"},
+		},
+		{
+			name: "hardlink through a symlink",
+			entries: func(string) []layerEntry {
+				return []layerEntry{symlinkEntry("link", "../../outside"), hardlinkEntry("h", "link/secret")}
+			},
+			rejected: []string{"h"},
+		},
+		{
+			name: "opaque whiteout below a symlink",
+			entries: func(string) []layerEntry {
+				return []layerEntry{symlinkEntry("link", "../../outside/victim"), fileEntry("link/.wh..wh..opq", "")}
+			},
+			rejected: []string{"link/.wh..wh..opq"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, dest, rejected := extractTestLayerAt(t, tt.entries)
+			if len(rejected) != len(tt.rejected) {
+				t.Fatalf("rejected %q, want %q", rejected, tt.rejected)
+			}
+			for i := range rejected {
+				if tt.rejected[i] != "*" && rejected[i] != tt.rejected[i] {
+					t.Errorf("rejected %q, want %q", rejected, tt.rejected)
+				}
+			}
+			assertStoreIntact(t, root)
+			if fi, err := os.Lstat(dest); err != nil || !fi.IsDir() {
+				t.Errorf("the layer directory is gone: %v", err)
+			}
+		})
+	}
+}
+
+func TestExtractLayerHardlinkInside(t *testing.T) {
+	_, dest, rejected := extractTestLayer(t, []layerEntry{
+		fileEntry("etc/passwd", "root"),
+		hardlinkEntry("etc/passwd-", "etc/passwd"),
+	})
+	if len(rejected) != 0 {
+		t.Fatalf("rejected %q", rejected)
+	}
+	a, err := os.Stat(filepath.Join(dest, "etc", "passwd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(filepath.Join(dest, "etc", "passwd-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, b) {
+		t.Error("etc/passwd- is not a hardlink to etc/passwd")
+	}
+}
+
+func TestExtractLayerDirectoryMetadata(t *testing.T) {
+	_, dest, _ := extractTestLayer(t, []layerEntry{
+		{name: "ro/", typeflag: tar.TypeDir, mode: 0555},
+		fileEntry("ro/file", "x"),
+		{name: "sticky/", typeflag: tar.TypeDir, mode: 01777},
+	})
+	for name, want := range map[string]os.FileMode{"ro": 0555, "sticky": 0777 | os.ModeSticky} {
+		fi, err := os.Lstat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode() & (os.ModePerm | os.ModeSticky); got != want {
+			t.Errorf("%s has mode %v, want %v", name, got, want)
+		}
+	}
+	if err := RemoveLayer(dest); err != nil {
+		t.Errorf("RemoveLayer: %v", err)
+	}
+}
+
+func TestExtractWhiteoutNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  []layerEntry
+		rejected []string
+	}{
+		{
+			name:     "whiteout of the parent of the layer",
+			entries:  []layerEntry{fileEntry(".wh...", "")},
+			rejected: []string{".wh..."},
+		},
+		{
+			name:     "whiteout of the layer root",
+			entries:  []layerEntry{fileEntry(".wh..", "")},
+			rejected: []string{".wh.."},
+		},
+		{
+			name:     "whiteout without a name",
+			entries:  []layerEntry{fileEntry(".wh.", "")},
+			rejected: []string{".wh."},
+		},
+		{
+			name:     "whiteout of its own directory",
+			entries:  []layerEntry{dirEntryOf("a/"), fileEntry("a/.wh...", "")},
+			rejected: []string{"a/.wh..."},
+		},
+		{
+			name:     "whiteout that climbs out",
+			entries:  []layerEntry{fileEntry("../.wh.other", "")},
+			rejected: []string{"../.wh.other"},
+		},
+		{
+			name:     "whiteout below a symlink",
+			entries:  []layerEntry{symlinkEntry("link", "../../outside"), fileEntry("link/.wh.secret", "")},
+			rejected: []string{"link/.wh.secret"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, _, rejected := extractTestLayer(t, tt.entries)
+			if len(rejected) != len(tt.rejected) {
+				t.Fatalf("rejected %q, want %q", rejected, tt.rejected)
+			}
+			for i := range rejected {
+				if rejected[i] != tt.rejected[i] {
+					t.Errorf("rejected %q, want %q", rejected, tt.rejected)
+				}
+			}
+			assertStoreIntact(t, root)
+		})
+	}
+}
+
+func TestExtractWhiteout(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating whiteout devices needs root")
+	}
+	_, dest, rejected := extractTestLayer(t, []layerEntry{
+		dirEntryOf("a/"),
+		fileEntry("a/.wh.b", ""),
+	})
+	if len(rejected) != 0 {
+		t.Fatalf("rejected %q", rejected)
+	}
+	var st unix.Stat_t
+	if err := unix.Lstat(filepath.Join(dest, "a", "b"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFCHR || st.Rdev != 0 {
+		t.Errorf("a/b has mode %o rdev %d, want a 0/0 character device", st.Mode, st.Rdev)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "a", ".wh.b")); !os.IsNotExist(err) {
+		t.Errorf("the .wh.b entry itself was written: %v", err)
+	}
+}
+
+func TestNewLayerReaderCompression(t *testing.T) {
+	layer := buildLayer(t, []layerEntry{fileEntry("etc/hostname", "crun\n")})
+	var gz, zst bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(layer)
+	gw.Close()
+	zw, err := zstd.NewWriter(&zst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(layer)
+	zw.Close()
+
+	const (
+		ociTar  = "application/vnd.oci.image.layer.v1.tar"
+		ociGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+		ociZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+		docker  = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	)
+	tests := []struct {
+		name      string
+		blob      []byte
+		mediaType string
+	}{
+		{"gzip", gz.Bytes(), ociGzip},
+		{"docker gzip", gz.Bytes(), docker},
+		{"zstd", zst.Bytes(), ociZstd},
+		{"uncompressed", layer, ociTar},
+		{"no media type", zst.Bytes(), ""},
+		{"gzip labelled as tar", gz.Bytes(), ociTar},
+		{"zstd labelled as gzip", zst.Bytes(), docker},
+		{"tar labelled as gzip", layer, ociGzip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewLayerReader(bytes.NewReader(tt.blob), tt.mediaType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, layer) {
+				t.Errorf("read %d bytes that are not the layer tar", len(got))
+			}
+		})
+	}
+
+	// a corrupt gzip blob says what its descriptor claimed
+	_, err = NewLayerReader(bytes.NewReader([]byte{0x1f, 0x8b, 0, 0}), ociTar)
+	if err == nil || !strings.Contains(err.Error(), "media type "+ociTar+" declares none") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestInstallLayer(t *testing.T) {
+	layerDir := t.TempDir()
+	fail := errors.New("unpack failed")
+	_, err := InstallLayer(layerDir, "abc", func(dir string) error {
+		// a read-only directory must not keep the temporary one around
+		if err := os.MkdirAll(filepath.Join(dir, "ro/sub"), 0755); err != nil {
+			return err
+		}
+		if err := os.Chmod(filepath.Join(dir, "ro"), 0555); err != nil {
+			return err
+		}
+		return fail
+	})
+	if !errors.Is(err, fail) {
+		t.Fatalf("got %v, want the unpack error", err)
+	}
+	if entries, _ := os.ReadDir(layerDir); len(entries) != 0 {
+		t.Fatalf("left %v behind", entries)
+	}
+
+	path, err := InstallLayer(layerDir, "abc", func(dir string) error {
+		return os.WriteFile(filepath.Join(dir, "file"), []byte("first"), 0644)
+	})
+	if err != nil || path != filepath.Join(layerDir, "abc") {
+		t.Fatalf("got %s, %v", path, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("layer mode %v, %v; want 0755", info.Mode(), err)
+	}
+
+	// another pull installed it first: that copy is kept
+	path, err = InstallLayer(layerDir, "abc", func(dir string) error {
+		return os.WriteFile(filepath.Join(dir, "file"), []byte("second"), 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(path, "file")); string(data) != "first" {
+		t.Errorf("installed layer replaced with %q", data)
+	}
+	if entries, _ := os.ReadDir(layerDir); len(entries) != 1 {
+		t.Errorf("layer directory holds %v", entries)
+	}
+}
+
+func TestCleanLayerTemps(t *testing.T) {
+	layerDir := t.TempDir()
+	// a pid that no longer runs
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip(err)
+	}
+	dead := cmd.Process.Pid
+	stale := filepath.Join(layerDir, fmt.Sprintf(".abc%s%d-1", layerTempInfix, dead))
+	running := filepath.Join(layerDir, fmt.Sprintf(".def%s%d-1", layerTempInfix, os.Getpid()))
+	for _, dir := range []string{filepath.Join(stale, "ro/sub"), running, filepath.Join(layerDir, "abc"), filepath.Join(layerDir, ".other")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(stale, "ro"), 0555); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := CleanLayerTemps(layerDir)
+	if err != nil || removed != 1 {
+		t.Fatalf("removed %d, %v; want the one stale directory", removed, err)
+	}
+	var left []string
+	entries, _ := os.ReadDir(layerDir)
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	want := []string{filepath.Base(running), ".other", "abc"}
+	slices.Sort(left)
+	slices.Sort(want)
+	if !slices.Equal(left, want) {
+		t.Errorf("left %q, want %q", left, want)
+	}
+
+	if removed, err := CleanLayerTemps(filepath.Join(layerDir, "missing")); err != nil || removed != 0 {
+		t.Errorf("missing directory: %d, %v", removed, err)
+	}
+}
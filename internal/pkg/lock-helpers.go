@@ -0,0 +1,124 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// Lock names shared by every crun process using a store.
+const (
+	// StoreLock is held shared by commands that read or add to the store
+	// and exclusive by the ones that delete from it.
+	StoreLock = "store"
+)
+
+// BlobLock is the name of the lock held while blobs/<hex> is downloaded.
+func BlobLock(hex string) string { return "blob-" + hex }
+
+// LayerLock is the name of the lock held while layers/<hex> is unpacked.
+func LayerLock(hex string) string { return "layer-" + hex }
+
+// Locker hands out flock(2) locks on files in RootDir/locks, which
+// serialize crun processes sharing a store. The kernel drops them when a
+// process exits, so a crashed crun never leaves the store locked. A nil
+// Locker hands out nil locks and does not lock anything.
+type Locker struct {
+	dir string
+
+	// OnWait, if set, is called with the lock name before blocking on a
+	// lock another process holds.
+	OnWait func(name string)
+}
+
+// Lock is a held lock; Unlock releases it.
+type Lock struct {
+	f *os.File
+}
+
+func NewLocker(rootDir string) *Locker {
+	return &Locker{dir: filepath.Join(rootDir, "locks")}
+}
+
+// Shared takes name for reading, alongside other readers.
+func (l *Locker) Shared(name string) (*Lock, error) {
+	return l.lock(name, unix.LOCK_SH)
+}
+
+// Exclusive takes name for writing, waiting for every other holder.
+func (l *Locker) Exclusive(name string) (*Lock, error) {
+	return l.lock(name, unix.LOCK_EX)
+}
+
+func (l *Locker) lock(name string, how int) (*Lock, error) {
+	if l == nil {
+		return nil, nil
+	}
+	if err := os.MkdirAll(l.dir, 0755); err != nil {
+		return nil, err
+	}
+	// flock needs no write access, so a lock file another user created can
+	// still be locked; O_CREATE only creates it when it is missing
+	f, err := os.OpenFile(filepath.Join(l.dir, name+".lock"), os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Flock(int(f.Fd()), how|unix.LOCK_NB)
+	if err == unix.EWOULDBLOCK {
+		if l.OnWait != nil {
+			l.OnWait(name)
+		}
+		err = flockRetry(f, how)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock %s: %w", name, err)
+	}
+	return &Lock{f: f}, nil
+}
+
+// flockRetry blocks on the lock, carrying on after signals interrupt it.
+func flockRetry(f *os.File, how int) error {
+	for {
+		err := unix.Flock(int(f.Fd()), how)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+// Remove deletes the files of locks nobody can be holding any more. Only
+// call it with the store lock held exclusively, since every other lock is
+// taken under the shared store lock.
+func (l *Locker) Remove(names ...string) {
+	if l == nil {
+		return
+	}
+	for _, name := range names {
+		_ = os.Remove(filepath.Join(l.dir, name+".lock"))
+	}
+}
+
+// RemoveUnused deletes the files of every lock but the store lock, with
+// the same precondition as Remove.
+func (l *Locker) RemoveUnused() {
+	if l == nil {
+		return
+	}
+	entries, _ := os.ReadDir(l.dir)
+	for _, e := range entries {
+		if e.Name() != StoreLock+".lock" {
+			_ = os.Remove(filepath.Join(l.dir, e.Name()))
+		}
+	}
+}
+
+// Unlock releases the lock. It is safe to call on a nil Lock.
+func (l *Lock) Unlock() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,73 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestLockReadOnlyFile(t *testing.T) {
+	root := t.TempDir()
+	first := NewLocker(root)
+	held, err := first.Exclusive(StoreLock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as left behind by a crun run by another user
+	path := filepath.Join(root, "locks", StoreLock+".lock")
+	if err := os.Chmod(path, 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	second := NewLocker(root)
+	waiting := make(chan string, 1)
+	second.OnWait = func(name string) { waiting <- name }
+	acquired := make(chan *Lock)
+	go func() {
+		l, err := second.Shared(StoreLock)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- l
+	}()
+
+	select {
+	case name := <-waiting:
+		if name != StoreLock {
+			t.Errorf("waited on %s", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the second opener did not wait for the exclusive lock")
+	}
+	if err := held.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	l := <-acquired
+	if l == nil {
+		t.Fatal("no lock")
+	}
+	defer l.Unlock()
+
+	flags, err := unix.FcntlInt(l.f.Fd(), unix.F_GETFL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags&unix.O_ACCMODE != unix.O_RDONLY {
+		t.Errorf("lock file opened with flags %#o, want read-only", flags)
+	}
+}
+
+func TestLockCreatesMissingFile(t *testing.T) {
+	root := t.TempDir()
+	l, err := NewLocker(root).Exclusive(BlobLock("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Unlock()
+	if _, err := os.Stat(filepath.Join(root, "locks", "blob-abc.lock")); err != nil {
+		t.Error(err)
+	}
+}
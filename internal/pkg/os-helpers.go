@@ -1,15 +1,63 @@
 package pkg
 
-import "runtime"
+import (
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
 
-type Platform struct {
-	OS   string
-	Arch string
+// IsTerminal reports whether f is connected to a terminal.
+func IsTerminal(f *os.File) bool {
+	var t syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&t)))
+	return errno == 0
 }
 
-func HostPlatform() Platform {
-	return Platform{
-		OS:   runtime.GOOS,
-		Arch: runtime.GOARCH,
+// TerminalWidth returns the number of columns of the terminal f is
+// connected to, or 0 if it is not a terminal.
+func TerminalWidth(f *os.File) int {
+	var ws struct{ Row, Col, Xpixel, Ypixel uint16 }
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 {
+		return 0
 	}
+	return int(ws.Col)
+}
+
+// ReadLine reads one line from f without buffering past the newline, so
+// several prompts can share stdin.
+func ReadLine(f *os.File) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := f.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF && len(line) > 0 {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSuffix(string(line), "\r"), nil
+}
+
+// ReadPassword reads a line from f with terminal echo turned off.
+func ReadPassword(f *os.File) (string, error) {
+	fd := f.Fd()
+	var old syscall.Termios
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&old))); errno == 0 {
+		noEcho := old
+		noEcho.Lflag &^= syscall.ECHO
+		syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&noEcho)))
+		defer syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&old)))
+	}
+	return ReadLine(f)
 }
@@ -0,0 +1,188 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Platform identifies what an image manifest was built for. Variant is the
+// arm version ("v7") or amd64 microarchitecture level ("v3").
+type Platform struct {
+	OS      string
+	Arch    string
+	Variant string
+}
+
+// String formats p as "os/arch[/variant]", leaving out the variant where
+// it is the one every image of that architecture targets.
+func (p Platform) String() string {
+	if p.Variant == "" || (p.Arch == "amd64" && p.Variant == "v1") || (p.Arch == "arm64" && p.Variant == "v8") {
+		return p.OS + "/" + p.Arch
+	}
+	return p.OS + "/" + p.Arch + "/" + p.Variant
+}
+
+// MarshalText makes p encode as its String form, e.g. in JSON.
+func (p Platform) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// HostPlatform returns the platform of this machine, with the variant its
+// CPU supports.
+func HostPlatform() Platform {
+	return NormalizePlatform(Platform{
+		OS:      runtime.GOOS,
+		Arch:    runtime.GOARCH,
+		Variant: hostVariant(runtime.GOARCH),
+	})
+}
+
+// ParsePlatform parses an "os/arch[/variant]" string such as the value of
+// --platform.
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || slices.Contains(parts, "") {
+		return Platform{}, fmt.Errorf("invalid platform %q: expected os/arch[/variant]", s)
+	}
+	p := Platform{OS: parts[0], Arch: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return NormalizePlatform(p), nil
+}
+
+// NormalizePlatform maps architecture aliases to GOARCH names and fills in
+// the default variant, so that "linux/aarch64" and "linux/arm64/v8" or
+// "linux/amd64" and "linux/amd64/v1" compare equal.
+func NormalizePlatform(p Platform) Platform {
+	p.OS = strings.ToLower(p.OS)
+	p.Arch = strings.ToLower(p.Arch)
+	p.Variant = strings.ToLower(p.Variant)
+	if p.Variant != "" && !strings.HasPrefix(p.Variant, "v") {
+		p.Variant = "v" + p.Variant
+	}
+	switch p.Arch {
+	case "x86_64", "x86-64":
+		p.Arch = "amd64"
+	case "aarch64":
+		p.Arch = "arm64"
+	case "armhf", "armv7l":
+		p.Arch, p.Variant = "arm", "v7"
+	case "armel":
+		p.Arch, p.Variant = "arm", "v6"
+	case "i386", "i686":
+		p.Arch = "386"
+	}
+	if p.Variant == "" {
+		switch p.Arch {
+		case "amd64":
+			p.Variant = "v1"
+		case "arm64":
+			p.Variant = "v8"
+		case "arm":
+			p.Variant = "v7"
+		}
+	}
+	return p
+}
+
+// MatchPlatform reports whether a machine of platform want can run an image
+// built for have, and how good a match it is: 0 is an exact match and
+// larger ranks are older variants that still run. Both platforms must be
+// normalized.
+func MatchPlatform(want, have Platform) (int, bool) {
+	if want.OS != have.OS || want.Arch != have.Arch {
+		return 0, false
+	}
+	rank := slices.Index(compatibleVariants(want), have.Variant)
+	return rank, rank >= 0
+}
+
+// BestPlatform returns the index of the candidate that best suits want, or
+// -1 if none of them can run there.
+func BestPlatform(want Platform, candidates []Platform) int {
+	best, bestRank := -1, 0
+	for i, have := range candidates {
+		if rank, ok := MatchPlatform(want, have); ok && (best < 0 || rank < bestRank) {
+			best, bestRank = i, rank
+		}
+	}
+	return best
+}
+
+// compatibleVariants lists the variants p can run, best first: an armv8 CPU
+// runs v8, v7, v6 and v5 code, an x86-64-v3 CPU runs v3 down to v1.
+func compatibleVariants(p Platform) []string {
+	lowest := map[string]int{"arm": 5, "arm64": 8, "amd64": 1}
+	low, ok := lowest[p.Arch]
+	n, err := strconv.Atoi(strings.TrimPrefix(p.Variant, "v"))
+	if !ok || err != nil || n < low {
+		return []string{p.Variant}
+	}
+	variants := make([]string, 0, n-low+1)
+	for ; n >= low; n-- {
+		variants = append(variants, "v"+strconv.Itoa(n))
+	}
+	return variants
+}
+
+// amd64Levels are the x86-64 microarchitecture levels above v1 with the
+// /proc/cpuinfo flags each one requires on top of the level below.
+var amd64Levels = []struct {
+	variant string
+	flags   []string
+}{
+	{"v2", []string{"cx16", "lahf_lm", "popcnt", "sse4_1", "sse4_2", "ssse3"}},
+	{"v3", []string{"avx", "avx2", "bmi1", "bmi2", "f16c", "fma", "abm", "movbe", "xsave"}},
+	{"v4", []string{"avx512f", "avx512bw", "avx512cd", "avx512dq", "avx512vl"}},
+}
+
+// hostVariant derives the CPU variant from /proc/cpuinfo, leaving it to
+// NormalizePlatform's defaults when that is not possible.
+func hostVariant(arch string) string {
+	switch arch {
+	case "arm":
+		// "CPU architecture: 7"; 64-bit cores report 8 and run v7 code too
+		v := cpuInfoField("CPU architecture")
+		if digits := v[:len(v)-len(strings.TrimLeft(v, "0123456789"))]; digits != "" {
+			return "v" + digits
+		}
+	case "amd64":
+		flags := strings.Fields(cpuInfoField("flags"))
+		variant := "v1"
+		for _, level := range amd64Levels {
+			for _, f := range level.flags {
+				if !slices.Contains(flags, f) {
+					return variant
+				}
+			}
+			variant = level.variant
+		}
+		return variant
+	}
+	return ""
+}
+
+// cpuInfoField returns the value of the first "key : value" line in
+// /proc/cpuinfo with the given key.
+func cpuInfoField(key string) string {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(scanner.Text(), ":")
+		if ok && strings.TrimSpace(k) == key {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,157 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNormalizePlatform(t *testing.T) {
+	tests := []struct {
+		in, want Platform
+	}{
+		{Platform{"linux", "amd64", ""}, Platform{"linux", "amd64", "v1"}},
+		{Platform{"Linux", "x86_64", ""}, Platform{"linux", "amd64", "v1"}},
+		{Platform{"linux", "amd64", "3"}, Platform{"linux", "amd64", "v3"}},
+		{Platform{"linux", "amd64", "v4"}, Platform{"linux", "amd64", "v4"}},
+		{Platform{"linux", "aarch64", ""}, Platform{"linux", "arm64", "v8"}},
+		{Platform{"linux", "arm64", "v8"}, Platform{"linux", "arm64", "v8"}},
+		{Platform{"linux", "arm", ""}, Platform{"linux", "arm", "v7"}},
+		{Platform{"linux", "armhf", ""}, Platform{"linux", "arm", "v7"}},
+		{Platform{"linux", "armv7l", ""}, Platform{"linux", "arm", "v7"}},
+		{Platform{"linux", "armel", ""}, Platform{"linux", "arm", "v6"}},
+		{Platform{"linux", "arm", "V6"}, Platform{"linux", "arm", "v6"}},
+		{Platform{"linux", "i686", ""}, Platform{"linux", "386", ""}},
+		{Platform{"linux", "riscv64", ""}, Platform{"linux", "riscv64", ""}},
+	}
+	for _, tt := range tests {
+		if got := NormalizePlatform(tt.in); got != tt.want {
+			t.Errorf("NormalizePlatform(%+v) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+
+	// the default variant is the same platform as none at all
+	for _, pair := range [][2]string{
+		{"linux/amd64", "linux/amd64/v1"},
+		{"linux/arm64", "linux/arm64/v8"},
+		{"linux/arm", "linux/arm/v7"},
+		{"linux/aarch64", "linux/arm64/v8"},
+	} {
+		a, err := ParsePlatform(pair[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ParsePlatform(pair[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a != b || a.String() != b.String() {
+			t.Errorf("%s = %+v (%s), %s = %+v (%s)", pair[0], a, a, pair[1], b, b)
+		}
+	}
+}
+
+func TestCompatibleVariants(t *testing.T) {
+	tests := []struct {
+		p    Platform
+		want []string
+	}{
+		{Platform{"linux", "arm", "v8"}, []string{"v8", "v7", "v6", "v5"}},
+		{Platform{"linux", "arm", "v6"}, []string{"v6", "v5"}},
+		{Platform{"linux", "arm64", "v8"}, []string{"v8"}},
+		{Platform{"linux", "amd64", "v3"}, []string{"v3", "v2", "v1"}},
+		{Platform{"linux", "amd64", "v1"}, []string{"v1"}},
+		{Platform{"linux", "riscv64", ""}, []string{""}},
+	}
+	for _, tt := range tests {
+		if got := compatibleVariants(tt.p); !slices.Equal(got, tt.want) {
+			t.Errorf("compatibleVariants(%s) = %q, want %q", tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestBestPlatform(t *testing.T) {
+	tests := []struct {
+		name       string
+		want       string
+		candidates []string
+		best       int
+	}{
+		{"exact", "linux/arm/v8", []string{"linux/arm/v6", "linux/arm/v8", "linux/arm/v7"}, 1},
+		{"arm v8 falls back to v7", "linux/arm/v8", []string{"linux/arm/v6", "linux/arm/v7"}, 1},
+		{"arm v8 falls back to v6", "linux/arm/v8", []string{"linux/arm64", "linux/arm/v6"}, 1},
+		{"amd64 v3 prefers v2 over v1", "linux/amd64/v3", []string{"linux/amd64", "linux/amd64/v2", "linux/amd64/v4"}, 1},
+		{"amd64 default variant", "linux/amd64", []string{"linux/amd64/v2", "linux/amd64/v1"}, 1},
+		{"no newer variant", "linux/arm/v6", []string{"linux/arm/v7", "linux/arm64"}, -1},
+		{"no amd64 variant", "linux/amd64/v1", []string{"linux/amd64/v3", "linux/arm64"}, -1},
+		{"other os", "linux/amd64", []string{"windows/amd64"}, -1},
+		{"none", "linux/amd64", nil, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := ParsePlatform(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var candidates []Platform
+			for _, c := range tt.candidates {
+				p, err := ParsePlatform(c)
+				if err != nil {
+					t.Fatal(err)
+				}
+				candidates = append(candidates, p)
+			}
+			if got := BestPlatform(want, candidates); got != tt.best {
+				t.Errorf("BestPlatform(%s, %q) = %d, want %d", tt.want, tt.candidates, got, tt.best)
+			}
+		})
+	}
+}
+
+// platformIndex builds an image index with one manifest per platform,
+// given as "os/arch[/variant]", whose digest is the platform string.
+func platformIndex(t *testing.T, platforms ...string) *OCIIndex {
+	t.Helper()
+	var manifests []string
+	for _, p := range platforms {
+		parts := append(strings.Split(p, "/"), "")
+		manifests = append(manifests, fmt.Sprintf(`{"digest":%q,"platform":{"os":%q,"architecture":%q,"variant":%q}}`, p, parts[0], parts[1], parts[2]))
+	}
+	var idx OCIIndex
+	if err := json.Unmarshal([]byte(`{"manifests":[`+strings.Join(manifests, ",")+`]}`), &idx); err != nil {
+		t.Fatal(err)
+	}
+	return &idx
+}
+
+func TestSelectPlatformManifest(t *testing.T) {
+	idx := platformIndex(t, "unknown/unknown", "linux/amd64", "linux/amd64/v2", "linux/arm/v6", "linux/arm/v7", "linux/aarch64")
+	tests := []struct {
+		want   Platform
+		digest string
+	}{
+		{Platform{"linux", "amd64", "v3"}, "linux/amd64/v2"},
+		{Platform{"linux", "amd64", ""}, "linux/amd64"},
+		{Platform{"linux", "x86_64", "v1"}, "linux/amd64"},
+		{Platform{"linux", "arm", "v8"}, "linux/arm/v7"},
+		{Platform{"linux", "armel", ""}, "linux/arm/v6"},
+		{Platform{"linux", "arm64", ""}, "linux/aarch64"},
+	}
+	for _, tt := range tests {
+		digest, _, err := SelectPlatformManifest(idx, tt.want)
+		if err != nil {
+			t.Errorf("%+v: %v", tt.want, err)
+			continue
+		}
+		if digest != tt.digest {
+			t.Errorf("%+v selected %s, want %s", tt.want, digest, tt.digest)
+		}
+	}
+
+	_, _, err := SelectPlatformManifest(idx, Platform{OS: "linux", Arch: "arm", Variant: "v5"})
+	if err == nil || !strings.Contains(err.Error(), "no manifest for linux/arm/v5") || strings.Contains(err.Error(), "unknown") {
+		t.Errorf("got %v, want the platforms available without attestations", err)
+	}
+}
@@ -0,0 +1,132 @@
+package reference
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	DefaultDomain = "docker.io"
+	DefaultTag    = "latest"
+	officialRepo  = "library/"
+	maxNameLength = 255
+)
+
+// Grammar from the distribution reference spec:
+//
+//	reference := name [ ":" tag ] [ "@" digest ]
+//	name      := [domain '/'] remote-name
+//	domain    := host [':' port-number]
+var (
+	domainRe    = regexp.MustCompile(`^(?:(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*|\[[a-fA-F0-9:]+\])(?::[0-9]+)?$`)
+	componentRe = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*$`)
+	tagRe       = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRe    = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+)
+
+// Reference is a parsed, normalized image reference. Domain and Path are
+// always set; Tag defaults to "latest" unless only a digest was given.
+type Reference struct {
+	Domain string
+	Path   string
+	Tag    string
+	Digest string
+}
+
+// Parse parses and normalizes an image reference, so "nginx" becomes
+// docker.io/library/nginx:latest and "localhost:5000/app@sha256:..."
+// keeps its registry host and digest.
+func Parse(s string) (Reference, error) {
+	if s == "" {
+		return Reference{}, fmt.Errorf("image reference is empty")
+	}
+	var ref Reference
+
+	name := s
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.Digest = name[:i], name[i+1:]
+		if err := validateDigest(ref.Digest); err != nil {
+			return Reference{}, fmt.Errorf("invalid reference %q: %w", s, err)
+		}
+	}
+	// the tag separator is the last ':' after the last '/', so a registry
+	// port such as localhost:5000/app is kept as part of the name
+	if i := strings.LastIndex(name, ":"); i >= 0 && !strings.Contains(name[i:], "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+		if !tagRe.MatchString(ref.Tag) {
+			return Reference{}, fmt.Errorf("invalid reference %q: invalid tag %q", s, ref.Tag)
+		}
+	}
+	if name == "" {
+		return Reference{}, fmt.Errorf("invalid reference %q: empty repository name", s)
+	}
+
+	ref.Domain, ref.Path = splitDomain(name)
+	if !domainRe.MatchString(ref.Domain) {
+		return Reference{}, fmt.Errorf("invalid reference %q: invalid registry host %q", s, ref.Domain)
+	}
+	for _, c := range strings.Split(ref.Path, "/") {
+		if !componentRe.MatchString(c) {
+			return Reference{}, fmt.Errorf("invalid reference %q: repository name must be lowercase alphanumerics separated by '.', '_' or '-'", s)
+		}
+	}
+	if len(ref.Name()) > maxNameLength {
+		return Reference{}, fmt.Errorf("invalid reference %q: repository name longer than %d characters", s, maxNameLength)
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = DefaultTag
+	}
+	return ref, nil
+}
+
+// splitDomain separates the registry host from the repository path. The
+// first component is a host only if it looks like one (contains '.' or ':',
+// is localhost, or has upper-case letters); otherwise the name lives on
+// Docker Hub, where single-component names are official library images.
+func splitDomain(name string) (string, string) {
+	domain, path := DefaultDomain, name
+	first, rest, ok := strings.Cut(name, "/")
+	if ok && (strings.ContainsAny(first, ".:") || first == "localhost" || strings.ToLower(first) != first) {
+		domain, path = first, rest
+	}
+	if domain == "index.docker.io" {
+		domain = DefaultDomain
+	}
+	if domain == DefaultDomain && !strings.Contains(path, "/") {
+		path = officialRepo + path
+	}
+	return domain, path
+}
+
+func validateDigest(d string) error {
+	if !digestRe.MatchString(d) {
+		return fmt.Errorf("invalid digest %q", d)
+	}
+	algo, hex, _ := strings.Cut(d, ":")
+	if algo != "sha256" {
+		return fmt.Errorf("unsupported digest algorithm %q", algo)
+	}
+	if len(hex) != 64 || strings.Trim(hex, "0123456789abcdef") != "" {
+		return fmt.Errorf("invalid sha256 digest %q", d)
+	}
+	return nil
+}
+
+// Name returns the canonical repository name, e.g. docker.io/library/nginx.
+func (r Reference) Name() string {
+	return r.Domain + "/" + r.Path
+}
+
+// String returns the canonical form of the reference, e.g.
+// docker.io/library/nginx:latest or ghcr.io/org/app@sha256:....
+func (r Reference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
@@ -0,0 +1,100 @@
+package reference
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		in   string
+		want Reference
+	}{
+		{"nginx", Reference{Domain: "docker.io", Path: "library/nginx", Tag: "latest"}},
+		{"nginx:1.25", Reference{Domain: "docker.io", Path: "library/nginx", Tag: "1.25"}},
+		{"user/app", Reference{Domain: "docker.io", Path: "user/app", Tag: "latest"}},
+		{"docker.io/nginx", Reference{Domain: "docker.io", Path: "library/nginx", Tag: "latest"}},
+		{"index.docker.io/nginx", Reference{Domain: "docker.io", Path: "library/nginx", Tag: "latest"}},
+		{"index.docker.io/user/app:v1", Reference{Domain: "docker.io", Path: "user/app", Tag: "v1"}},
+		{"ghcr.io/org/app", Reference{Domain: "ghcr.io", Path: "org/app", Tag: "latest"}},
+		// a single component on another registry gets no library/ prefix
+		{"ghcr.io/app", Reference{Domain: "ghcr.io", Path: "app", Tag: "latest"}},
+		{"localhost/app", Reference{Domain: "localhost", Path: "app", Tag: "latest"}},
+		{"localhost:5000/app", Reference{Domain: "localhost:5000", Path: "app", Tag: "latest"}},
+		{"localhost:5000/app:2", Reference{Domain: "localhost:5000", Path: "app", Tag: "2"}},
+		{"[::1]:5000/app", Reference{Domain: "[::1]:5000", Path: "app", Tag: "latest"}},
+		// an upper-case first component can only be a host
+		{"Foo/bar", Reference{Domain: "Foo", Path: "bar", Tag: "latest"}},
+		{"nginx@" + digest, Reference{Domain: "docker.io", Path: "library/nginx", Digest: digest}},
+		{"nginx:1.25@" + digest, Reference{Domain: "docker.io", Path: "library/nginx", Tag: "1.25", Digest: digest}},
+		{"localhost:5000/app:2@" + digest, Reference{Domain: "localhost:5000", Path: "app", Tag: "2", Digest: digest}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := Parse(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Parse(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseString(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		in, name, str string
+	}{
+		{"nginx", "docker.io/library/nginx", "docker.io/library/nginx:latest"},
+		{"index.docker.io/library/nginx:1", "docker.io/library/nginx", "docker.io/library/nginx:1"},
+		{"ghcr.io/org/app@" + digest, "ghcr.io/org/app", "ghcr.io/org/app@" + digest},
+		{"app:1@" + digest, "docker.io/library/app", "docker.io/library/app:1@" + digest},
+	}
+	for _, tt := range tests {
+		ref, err := Parse(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref.Name() != tt.name || ref.String() != tt.str {
+			t.Errorf("Parse(%q) = %s, %s; want %s, %s", tt.in, ref.Name(), ref, tt.name, tt.str)
+		}
+		// the canonical form parses back to itself
+		if again, err := Parse(ref.String()); err != nil || again != ref {
+			t.Errorf("Parse(%q) = %+v, %v; want %+v", ref, again, err, ref)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		in, err string
+	}{
+		{"", "empty"},
+		{"a//b", "repository name must be lowercase"},
+		{"-a/b", "repository name must be lowercase"},
+		{"a/b-", "repository name must be lowercase"},
+		{"docker.io/Nginx", "repository name must be lowercase"},
+		{"nginx:", "invalid tag"},
+		{"nginx:-1", "invalid tag"},
+		{":1", "empty repository name"},
+		{"nginx@sha256:abc", "invalid digest"},
+		{"nginx@md5:" + strings.Repeat("a", 32), "unsupported digest algorithm"},
+		{"nginx@sha256:" + strings.Repeat("A", 64), "invalid sha256 digest"},
+		{"-bad.example.com/app", "invalid registry host"},
+		{"ghcr.io/" + strings.Repeat("a", 256), "longer than 255"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			ref, err := Parse(tt.in)
+			if err == nil {
+				t.Fatalf("Parse(%q) = %+v, want an error", tt.in, ref)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Parse(%q) error %q, want it to mention %q", tt.in, err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// challenge is a parsed WWW-Authenticate header, e.g.
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io".
+type challenge struct {
+	Scheme string
+	Params map[string]string
+}
+
+func parseChallenge(header string) (challenge, error) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return challenge{}, fmt.Errorf("no WWW-Authenticate challenge")
+	}
+	scheme, rest, _ := strings.Cut(header, " ")
+	ch := challenge{Scheme: strings.ToLower(scheme), Params: make(map[string]string)}
+
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimLeft(rest, ", ") {
+		key, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		var value string
+		if strings.HasPrefix(after, `"`) {
+			// quoted-string: values such as scope may contain commas
+			end := 1
+			var b strings.Builder
+			for end < len(after) && after[end] != '"' {
+				if after[end] == '\\' && end+1 < len(after) {
+					end++
+				}
+				b.WriteByte(after[end])
+				end++
+			}
+			value = b.String()
+			rest = after[min(end+1, len(after)):]
+		} else {
+			value, rest, _ = strings.Cut(after, ",")
+			value = strings.TrimSpace(value)
+		}
+		ch.Params[key] = value
+	}
+	return ch, nil
+}
+
+// authorize answers ch for the given scope and returns the value to send in
+// the Authorization header.
+func (c *Client) authorize(ch challenge, scope string) (string, error) {
+	var authz string
+	switch ch.Scheme {
+	case "bearer":
+		token, err := c.fetchToken(ch, scope)
+		if err != nil {
+			return "", err
+		}
+		authz = "Bearer " + token
+	case "basic":
+		// an identity token is only good for a token server
+		if c.creds == nil || c.creds.Username == "" && c.creds.Password == "" {
+			return "", fmt.Errorf("%s requires authentication, run: crun login %s", c.Host, c.Host)
+		}
+		authz = "Basic " + basicAuth(c.creds)
+	default:
+		return "", fmt.Errorf("%s: unsupported auth scheme %q", c.Host, ch.Scheme)
+	}
+	c.storeAuth(scope, authz)
+	return authz, nil
+}
+
+func basicAuth(creds *Credentials) string {
+	return base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password))
+}
+
+// oauthClientID identifies crun to token servers in OAuth2 requests.
+const oauthClientID = "crun"
+
+// fetchToken requests a bearer token from the realm advertised in the
+// challenge, authenticating with the client's credentials when it has
+// them and anonymously otherwise.
+func (c *Client) fetchToken(ch challenge, scope string) (string, error) {
+	realm := ch.Params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("%s: bearer challenge without realm", c.Host)
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("%s: invalid token realm %q: %w", c.Host, realm, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout*MaxAttempts)
+	defer cancel()
+	var req *http.Request
+	if c.creds != nil && c.creds.IdentityToken != "" {
+		req, err = c.refreshTokenRequest(ctx, u, ch, scope)
+	} else {
+		req, err = c.tokenRequest(ctx, u, ch, scope)
+	}
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request to %s failed: %w", u.Host, newError(resp))
+	}
+	defer resp.Body.Close()
+	var data struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return "", err
+	}
+	if data.Token == "" {
+		data.Token = data.AccessToken
+	}
+	if data.Token == "" {
+		return "", fmt.Errorf("token response from %s carried no token", u.Host)
+	}
+	return data.Token, nil
+}
+
+// tokenRequest is the GET of the docker token protocol, carrying the
+// username and password as basic auth.
+func (c *Client) tokenRequest(ctx context.Context, realm *url.URL, ch challenge, scope string) (*http.Request, error) {
+	u := *realm
+	q := u.Query()
+	if service := ch.Params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	// a request may need several scopes, e.g. push access to one
+	// repository and pull access to the one a blob is mounted from
+	for _, s := range strings.Fields(scope) {
+		q.Add("scope", s)
+	}
+	if c.creds != nil {
+		q.Set("account", c.creds.Username)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.creds != nil {
+		req.Header.Set("Authorization", "Basic "+basicAuth(c.creds))
+	}
+	return req, nil
+}
+
+// refreshTokenRequest exchanges the client's identity token for an access
+// token: an OAuth2 refresh_token grant POSTed to the realm, as docker does.
+func (c *Client) refreshTokenRequest(ctx context.Context, realm *url.URL, ch challenge, scope string) (*http.Request, error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {c.creds.IdentityToken},
+		"client_id":     {oauthClientID},
+	}
+	if service := ch.Params["service"]; service != "" {
+		form.Set("service", service)
+	}
+	if scope != "" {
+		form.Set("scope", scope)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", realm.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
@@ -0,0 +1,402 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DockerHubHost     = "docker.io"
+	DockerHubEndpoint = "registry-1.docker.io"
+)
+
+const ManifestAccept = "application/vnd.oci.image.index.v1+json, " +
+	"application/vnd.docker.distribution.manifest.list.v2+json, " +
+	"application/vnd.oci.image.manifest.v1+json, " +
+	"application/vnd.docker.distribution.manifest.v2+json"
+
+const (
+	// RequestTimeout bounds requests whose bodies are small (manifests,
+	// tokens). Blob transfers are bounded by StallTimeout instead, since a
+	// healthy 2GB download can take arbitrarily long.
+	RequestTimeout = 30 * time.Second
+	StallTimeout   = 60 * time.Second
+
+	MaxAttempts   = 5
+	backoffBase   = 500 * time.Millisecond
+	backoffMax    = 10 * time.Second
+	maxRetryAfter = 30 * time.Second
+)
+
+// Client talks to a single registry endpoint using the OCI distribution API.
+// Authentication is discovered from the WWW-Authenticate challenge the
+// registry returns, so the same client works for Docker Hub, ghcr-style
+// registries and self-hosted distribution servers.
+type Client struct {
+	Host   string
+	Scheme string
+
+	creds  *Credentials
+	http   *http.Client
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+// Options configure a Client.
+type Options struct {
+	// Credentials are used for basic auth and for the bearer token
+	// exchange. Without them the client only asks for anonymous tokens.
+	Credentials *Credentials
+
+	// PlainHTTP talks to the registry over http instead of https. Loopback
+	// registries always use http.
+	PlainHTTP bool
+
+	// TLSConfig replaces the default TLS settings for https registries.
+	TLSConfig *tls.Config
+}
+
+// NewClient returns a client for the registry at host (e.g. "docker.io",
+// "ghcr.io", "localhost:5000"). Docker Hub is mapped to its API endpoint
+// and loopback registries are spoken to over plain http.
+func NewClient(host string, opts Options) *Client {
+	if host == "" || host == DockerHubHost || host == "index.docker.io" {
+		host = DockerHubEndpoint
+	}
+	scheme := "https"
+	if opts.PlainHTTP || isLoopback(host) {
+		scheme = "http"
+	}
+	return &Client{
+		Host:   host,
+		Scheme: scheme,
+		creds:  opts.Credentials,
+		http:   &http.Client{Transport: newTransport(opts.TLSConfig)},
+		tokens: make(map[string]string),
+	}
+}
+
+func newTransport(tlsConfig *tls.Config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{Timeout: 15 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	t.TLSHandshakeTimeout = 15 * time.Second
+	t.ResponseHeaderTimeout = RequestTimeout
+	if tlsConfig != nil {
+		t.TLSClientConfig = tlsConfig
+	}
+	return t
+}
+
+// TLSConfig builds the TLS settings for a registry whose certificate is
+// signed by the CA bundle in caFile, or is not checked at all when
+// skipVerify is set. It returns nil when neither is requested.
+func TLSConfig(caFile string, skipVerify bool) (*tls.Config, error) {
+	if caFile == "" && !skipVerify {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: skipVerify}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+func isLoopback(host string) bool {
+	h := host
+	if sh, _, err := net.SplitHostPort(host); err == nil {
+		h = sh
+	}
+	if h == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(h, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+func (c *Client) url(format string, args ...any) string {
+	return fmt.Sprintf("%s://%s", c.Scheme, c.Host) + fmt.Sprintf(format, args...)
+}
+
+// GetManifest fetches the manifest or index stored under ref (a tag or a
+// digest) and returns its raw bytes together with the response media type.
+func (c *Client) GetManifest(repo, ref string) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout*MaxAttempts)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url("/v2/%s/manifests/%s", repo, ref), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", ManifestAccept)
+	resp, err := c.do(req, repo)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("get manifest %s:%s: %w", repo, ref, newError(resp))
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", asTransportError(err)
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// Ping checks that the registry speaks the distribution API and that the
+// client's credentials are accepted, by authenticating against /v2/.
+func (c *Client) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout*MaxAttempts)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url("/v2/"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.doScope(req, "")
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		resp.Body.Close()
+		return nil
+	case http.StatusUnauthorized:
+		return fmt.Errorf("%s: credentials rejected: %w", c.Host, newError(resp))
+	}
+	return fmt.Errorf("%s: %w", c.Host, newError(resp))
+}
+
+// ErrRangeNotSatisfiable is returned by GetBlob when the registry rejects
+// the requested offset, e.g. because a partial download is already longer
+// than the blob.
+var ErrRangeNotSatisfiable = errors.New("requested range not satisfiable")
+
+// GetBlob starts a download of the blob with the given digest. A non-zero
+// offset asks for the rest of the blob with a Range request; registries
+// that ignore it answer 200 with the whole blob, so callers must check the
+// status code (206 means the body starts at offset). The caller owns the
+// returned response body, which fails if no data arrives for StallTimeout.
+func (c *Client) GetBlob(repo, digest string, offset int64) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url("/v2/%s/blobs/%s", repo, digest), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.do(req, repo)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		resp.Body = newStallReader(resp.Body, cancel, StallTimeout)
+		return resp, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		cancel()
+		return nil, ErrRangeNotSatisfiable
+	}
+	err = fmt.Errorf("failed to download %s: %w", digest, newError(resp))
+	cancel()
+	return nil, err
+}
+
+// do sends req with pull access to repo, answering an authentication
+// challenge once if the registry asks for one.
+func (c *Client) do(req *http.Request, repo string) (*http.Response, error) {
+	return c.doScope(req, fmt.Sprintf("repository:%s:pull", repo))
+}
+
+func (c *Client) doScope(req *http.Request, scope string) (*http.Response, error) {
+	if authz := c.cachedAuth(scope); authz != "" {
+		req.Header.Set("Authorization", authz)
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	header := resp.Header.Get("WWW-Authenticate")
+	unauthorized := newError(resp)
+
+	ch, err := parseChallenge(header)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.Host, unauthorized)
+	}
+	authz, err := c.authorize(ch, scope)
+	if err != nil {
+		return nil, err
+	}
+	retry, err := cloneRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	retry.Header.Set("Authorization", authz)
+	return c.send(retry)
+}
+
+// send performs req, retrying with bounded exponential backoff on
+// connection errors, 5xx responses and 429s. A 429 is retried after the
+// delay the registry asks for, unless that delay is too long to wait out,
+// in which case the error tells the user when to try again.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; attempt < MaxAttempts; attempt++ {
+		if attempt > 0 {
+			var err error
+			if req, err = cloneRequest(req); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := c.http.Do(req)
+		var wait time.Duration
+		switch {
+		case err != nil:
+			err = asTransportError(err)
+			if !Retryable(err) || req.Context().Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			wait = Backoff(attempt)
+		case resp.StatusCode == http.StatusTooManyRequests:
+			regErr := newError(resp)
+			if regErr.RetryAfter > maxRetryAfter {
+				return nil, regErr
+			}
+			lastErr = regErr
+			wait = max(regErr.RetryAfter, Backoff(attempt))
+		case resp.StatusCode >= 500:
+			lastErr = newError(resp)
+			wait = Backoff(attempt)
+		default:
+			return resp, nil
+		}
+		if attempt == MaxAttempts-1 {
+			break
+		}
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	return nil, &exhaustedError{attempts: MaxAttempts, err: lastErr}
+}
+
+// exhaustedError wraps the last failure once send has used up its
+// attempts, so Retryable tells callers not to retry it again.
+type exhaustedError struct {
+	attempts int
+	err      error
+}
+
+func (e *exhaustedError) Error() string {
+	return fmt.Sprintf("%v (gave up after %d attempts)", e.err, e.attempts)
+}
+
+func (e *exhaustedError) Unwrap() error {
+	return e.err
+}
+
+// Backoff returns the delay before retry number attempt+1: exponential
+// from backoffBase, capped at backoffMax, with jitter so parallel workers
+// do not retry in lockstep.
+func Backoff(attempt int) time.Duration {
+	d := backoffBase << attempt
+	if d <= 0 || d > backoffMax {
+		d = backoffMax
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+func cloneRequest(req *http.Request) (*http.Request, error) {
+	clone := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		clone.Body = body
+	}
+	return clone, nil
+}
+
+// cachedAuth returns the Authorization header value that last worked for
+// scope, so the challenge round trip is paid once per scope.
+func (c *Client) cachedAuth(scope string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tokens[scope]
+}
+
+func (c *Client) storeAuth(scope, authz string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens[scope] = authz
+}
+
+// stallReader cancels a download whose body stops producing data for
+// longer than timeout.
+type stallReader struct {
+	io.ReadCloser
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	timeout time.Duration
+}
+
+func newStallReader(body io.ReadCloser, cancel context.CancelFunc, timeout time.Duration) *stallReader {
+	return &stallReader{
+		ReadCloser: body,
+		timer:      time.AfterFunc(timeout, cancel),
+		cancel:     cancel,
+		timeout:    timeout,
+	}
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	if err != nil && errors.Is(err, context.Canceled) {
+		err = fmt.Errorf("no data received for %s: %w", r.timeout, io.ErrUnexpectedEOF)
+	}
+	if err != nil && err != io.EOF {
+		err = asTransportError(err)
+	}
+	return n, err
+}
+
+func (r *stallReader) Close() error {
+	r.timer.Stop()
+	err := r.ReadCloser.Close()
+	r.cancel()
+	return err
+}
@@ -0,0 +1,203 @@
+package registry
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestClient starts a registry serving handler and returns a client for
+// it. Loopback registries are spoken to over plain http.
+func newTestClient(t *testing.T, handler http.Handler, creds *Credentials) (*Client, *httptest.Server) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return NewClient(strings.TrimPrefix(srv.URL, "http://"), Options{Credentials: creds}), srv
+}
+
+func TestBearerChallenge(t *testing.T) {
+	tests := []struct {
+		name  string
+		creds *Credentials
+		// tokenField is the JSON field the token server answers with
+		tokenField string
+	}{
+		{"anonymous", nil, "token"},
+		{"with credentials", &Credentials{Username: "ci", Password: "s3cret"}, "token"},
+		{"oauth2 access_token", nil, "access_token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tokenRequests atomic.Int32
+			mux := http.NewServeMux()
+			var realm string
+			mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+				tokenRequests.Add(1)
+				q := r.URL.Query()
+				if q.Get("service") != "test-registry" || q.Get("scope") != "repository:team/app:pull" {
+					t.Errorf("token request %s, want service and scope from the challenge", r.URL.RawQuery)
+				}
+				user, pass, ok := r.BasicAuth()
+				if tt.creds == nil && ok {
+					t.Errorf("anonymous token request sent credentials for %s", user)
+				}
+				if tt.creds != nil && (user != tt.creds.Username || pass != tt.creds.Password || q.Get("account") != tt.creds.Username) {
+					t.Errorf("token request authenticated as %q/%q, account %q", user, pass, q.Get("account"))
+				}
+				json.NewEncoder(w).Encode(map[string]string{tt.tokenField: "tok"})
+			})
+			mux.HandleFunc("/v2/team/app/manifests/1", func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer tok" {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm+`",service="test-registry",scope="repository:team/app:pull"`)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+				io.WriteString(w, `{"schemaVersion":2}`)
+			})
+			c, srv := newTestClient(t, mux, tt.creds)
+			realm = srv.URL + "/token"
+
+			for range 2 {
+				data, mediaType, err := c.GetManifest("team/app", "1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != `{"schemaVersion":2}` || mediaType != "application/vnd.oci.image.manifest.v1+json" {
+					t.Errorf("got %s (%s)", data, mediaType)
+				}
+			}
+			if n := tokenRequests.Load(); n != 1 {
+				t.Errorf("%d token requests, want the token reused", n)
+			}
+		})
+	}
+}
+
+func TestIdentityToken(t *testing.T) {
+	mux := http.NewServeMux()
+	var realm string
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			t.Errorf("%s token request, want the refresh token POSTed", r.Method)
+		}
+		if _, _, ok := r.BasicAuth(); ok {
+			t.Error("token request sent basic auth alongside the identity token")
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{
+			"grant_type":    "refresh_token",
+			"refresh_token": "idtok",
+			"client_id":     "crun",
+			"service":       "test-registry",
+			"scope":         "repository:team/app:pull",
+		}
+		for k, v := range want {
+			if got := r.PostForm.Get(k); got != v {
+				t.Errorf("%s = %q, want %q", k, got, v)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "tok"})
+	})
+	mux.HandleFunc("/v2/team/app/manifests/1", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm+`",service="test-registry",scope="repository:team/app:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, "{}")
+	})
+	c, srv := newTestClient(t, mux, &Credentials{IdentityToken: "idtok"})
+	realm = srv.URL + "/token"
+	if _, _, err := c.GetManifest("team/app", "1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBasicChallenge(t *testing.T) {
+	creds := &Credentials{Username: "ci", Password: "s3cret"}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != creds.Username || pass != creds.Password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, "{}")
+	})
+
+	c, _ := newTestClient(t, handler, creds)
+	if _, _, err := c.GetManifest("app", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ping(); err != nil {
+		t.Errorf("ping with credentials: %v", err)
+	}
+
+	c, _ = newTestClient(t, handler, nil)
+	if _, _, err := c.GetManifest("app", "1"); err == nil || !strings.Contains(err.Error(), "crun login") {
+		t.Errorf("without credentials got %v, want a hint to log in", err)
+	}
+
+	c, _ = newTestClient(t, handler, &Credentials{Username: "ci", Password: "wrong"})
+	if err := c.Ping(); err == nil || !strings.Contains(err.Error(), "credentials rejected") {
+		t.Errorf("ping with wrong credentials got %v", err)
+	}
+}
+
+func TestAnonymousRegistry(t *testing.T) {
+	c, _ := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authz := r.Header.Get("Authorization"); authz != "" {
+			t.Errorf("sent Authorization %q to a registry that asked for none", authz)
+		}
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		io.WriteString(w, "{}")
+	}), &Credentials{Username: "ci", Password: "s3cret"})
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.GetManifest("app", "1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnsupportedChallenge(t *testing.T) {
+	c, _ := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Negotiate`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}), nil)
+	if _, _, err := c.GetManifest("app", "1"); err == nil || !strings.Contains(err.Error(), `unsupported auth scheme "negotiate"`) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	ch, err := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:a:pull,push repository:b:pull"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:a:pull,push repository:b:pull",
+	}
+	if ch.Scheme != "bearer" || len(ch.Params) != len(want) {
+		t.Fatalf("got %+v", ch)
+	}
+	for k, v := range want {
+		if ch.Params[k] != v {
+			t.Errorf("%s = %q, want %q", k, ch.Params[k], v)
+		}
+	}
+	if _, err := parseChallenge(""); err == nil {
+		t.Error("empty challenge parsed")
+	}
+}
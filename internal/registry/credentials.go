@@ -0,0 +1,245 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AuthFileName is the credential store kept under Config.RootDir. It uses
+// the auth.json format shared by docker, podman and skopeo.
+const AuthFileName = "auth.json"
+
+// Credentials are the username and password (or token) used for a registry.
+// IdentityToken, if set, is an OAuth2 refresh token the registry's token
+// server exchanges for access tokens instead of the password.
+type Credentials struct {
+	Username      string
+	Password      string
+	IdentityToken string
+}
+
+type authEntry struct {
+	Auth          string `json:"auth,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// AuthFile is the on-disk auth.json document. Unknown keys written by other
+// tools are preserved when the file is rewritten.
+//
+// As in docker's config.json, credentials can live in external
+// docker-credential-* helpers instead of the file: CredHelpers names the
+// helper for individual registries and CredsStore the helper for all others.
+type AuthFile struct {
+	Auths       map[string]authEntry `json:"auths"`
+	CredHelpers map[string]string    `json:"credHelpers,omitempty"`
+	CredsStore  string               `json:"credsStore,omitempty"`
+
+	path  string
+	extra map[string]json.RawMessage
+}
+
+// AuthFilePath returns the location of the credential store.
+func AuthFilePath(rootDir string) string {
+	return filepath.Join(rootDir, AuthFileName)
+}
+
+// LoadAuthFile reads the credential store at path. A missing file is an
+// empty store.
+func LoadAuthFile(path string) (*AuthFile, error) {
+	f := &AuthFile{Auths: make(map[string]authEntry), path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return f, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &f.extra); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if raw, ok := f.extra["auths"]; ok {
+		if err := json.Unmarshal(raw, &f.Auths); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		if f.Auths == nil {
+			f.Auths = make(map[string]authEntry)
+		}
+	}
+	if raw, ok := f.extra["credHelpers"]; ok {
+		if err := json.Unmarshal(raw, &f.CredHelpers); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	if raw, ok := f.extra["credsStore"]; ok {
+		if err := json.Unmarshal(raw, &f.CredsStore); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	return f, nil
+}
+
+// Save writes the store back with 0600 permissions.
+func (f *AuthFile) Save() error {
+	if f.extra == nil {
+		f.extra = make(map[string]json.RawMessage)
+	}
+	auths, err := json.Marshal(f.Auths)
+	if err != nil {
+		return err
+	}
+	f.extra["auths"] = auths
+	data, err := json.MarshalIndent(f.extra, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of an existing file, so enforce it
+	if err := os.Chmod(tmp, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// Get returns the credentials stored for host, if any. A configured
+// credential helper is asked first; entries in the file itself are used
+// when the helper has nothing for host.
+func (f *AuthFile) Get(host string) (*Credentials, error) {
+	if helper := f.helper(host); helper != "" {
+		creds, err := helper.get(helperServerURL(host))
+		if err == nil {
+			return creds, nil
+		}
+		if !errors.Is(err, errCredentialsNotFound) {
+			return nil, err
+		}
+	}
+	for _, key := range authKeys(host) {
+		entry, ok := f.Auths[key]
+		if !ok || entry.Auth == "" && entry.IdentityToken == "" {
+			continue
+		}
+		creds := &Credentials{IdentityToken: entry.IdentityToken}
+		if entry.Auth != "" {
+			raw, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth entry for %s: %w", key, err)
+			}
+			user, pass, ok := strings.Cut(string(raw), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid auth entry for %s", key)
+			}
+			creds.Username, creds.Password = user, pass
+		}
+		return creds, nil
+	}
+	return nil, nil
+}
+
+// Set records credentials for host, replacing any older entry. When a
+// credential helper is configured for host the secret goes to the helper
+// and the file only keeps an empty entry, as docker login does.
+func (f *AuthFile) Set(host string, creds Credentials) error {
+	if _, err := f.Erase(host); err != nil && !errors.Is(err, errCredentialsNotFound) {
+		return err
+	}
+	if helper := f.helper(host); helper != "" {
+		if err := helper.store(helperServerURL(host), creds); err != nil {
+			return err
+		}
+		f.Auths[NormalizeHost(host)] = authEntry{}
+		return nil
+	}
+	var entry authEntry
+	if creds.Username != "" || creds.Password != "" {
+		entry.Auth = base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password))
+	}
+	entry.IdentityToken = creds.IdentityToken
+	f.Auths[NormalizeHost(host)] = entry
+	return nil
+}
+
+// Erase removes every entry for host, including the one held by its
+// credential helper, and reports whether one existed.
+func (f *AuthFile) Erase(host string) (bool, error) {
+	found := false
+	for _, key := range authKeys(host) {
+		if _, ok := f.Auths[key]; ok {
+			delete(f.Auths, key)
+			found = true
+		}
+	}
+	if helper := f.helper(host); helper != "" {
+		err := helper.erase(helperServerURL(host))
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, errCredentialsNotFound) {
+			return found, err
+		}
+	}
+	return found, nil
+}
+
+// helper returns the credential helper responsible for host: its
+// credHelpers entry, else the default credsStore, else none.
+func (f *AuthFile) helper(host string) credHelper {
+	for _, key := range authKeys(host) {
+		if name, ok := f.CredHelpers[key]; ok && name != "" {
+			return credHelper(name)
+		}
+	}
+	return credHelper(f.CredsStore)
+}
+
+// helperServerURL is the server URL helpers store host under. Docker keys
+// Docker Hub by its legacy v1 URL and every other registry by host name.
+func helperServerURL(host string) string {
+	host = NormalizeHost(host)
+	if host == DockerHubHost {
+		return "https://index.docker.io/v1/"
+	}
+	return host
+}
+
+// NormalizeHost turns what users type for a registry ("https://ghcr.io/",
+// "index.docker.io") into the host name credentials are keyed by.
+func NormalizeHost(host string) string {
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+	host, _, _ = strings.Cut(host, "/")
+	switch host {
+	case "", "index.docker.io", DockerHubEndpoint:
+		return DockerHubHost
+	}
+	return host
+}
+
+// authKeys lists the keys host may be stored under. Docker writes Docker
+// Hub credentials under its legacy v1 URL.
+func authKeys(host string) []string {
+	host = NormalizeHost(host)
+	if host == DockerHubHost {
+		return []string{DockerHubHost, "https://index.docker.io/v1/", "index.docker.io", DockerHubEndpoint}
+	}
+	return []string{host, "https://" + host, "http://" + host}
+}
+
+// LoadCredentials looks up the credentials for host in the store under
+// rootDir. It returns nil when none are stored.
+func LoadCredentials(rootDir, host string) (*Credentials, error) {
+	f, err := LoadAuthFile(AuthFilePath(rootDir))
+	if err != nil {
+		return nil, err
+	}
+	return f.Get(host)
+}
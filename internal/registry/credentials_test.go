@@ -0,0 +1,245 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// stubHelper is a docker-credential-* helper keeping one JSON file per
+// server URL in $STUB_STORE, and answering like the real ones do.
+const stubHelper = `#!/bin/sh
+if [ "$1" = store ]; then
+	req=$(cat)
+	url=$(printf '%s' "$req" | sed -n 's/.*"ServerURL":"\([^"]*\)".*/\1/p')
+else
+	url=$(cat)
+fi
+echo "$1 $url" >> "$STUB_STORE/calls"
+file="$STUB_STORE/$(printf '%s' "$url" | cksum | cut -d' ' -f1)"
+case "$1" in
+store)
+	printf '%s' "$req" > "$file" ;;
+get|erase)
+	if [ ! -f "$file" ]; then
+		echo "credentials not found in native keychain"
+		exit 1
+	fi
+	if [ "$1" = get ]; then cat "$file"; else rm "$file"; fi ;;
+*)
+	echo "unknown action $1"
+	exit 1 ;;
+esac
+`
+
+// installStubHelper puts docker-credential-stub first on PATH and returns
+// the log of the calls made to it.
+func installStubHelper(t *testing.T) func() []string {
+	t.Helper()
+	bin, store := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, credHelperPrefix+"stub"), []byte(stubHelper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("STUB_STORE", store)
+	return func() []string {
+		data, _ := os.ReadFile(filepath.Join(store, "calls"))
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+}
+
+func TestCredentialHelperRoundTrip(t *testing.T) {
+	calls := installStubHelper(t)
+	root := t.TempDir()
+	path := AuthFilePath(root)
+	if err := os.WriteFile(path, []byte(`{"credsStore":"stub","credHelpers":{"ghcr.io":"stub"},"currentContext":"kept"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := LoadAuthFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := Credentials{Username: "ci", Password: "hub-secret"}
+	ghcr := Credentials{Username: "bot", Password: "ghcr-secret"}
+	if err := f.Set("index.docker.io", hub); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Set("https://ghcr.io/", ghcr); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") {
+		t.Errorf("auth.json holds a secret the helper stores:\n%s", data)
+	}
+	if !strings.Contains(string(data), `"currentContext": "kept"`) {
+		t.Errorf("auth.json lost a key other tools wrote:\n%s", data)
+	}
+
+	// a new process reads them back through the helper
+	for _, stored := range []struct {
+		host  string
+		creds Credentials
+	}{{DockerHubHost, hub}, {"ghcr.io", ghcr}} {
+		got, err := LoadCredentials(root, stored.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil || *got != stored.creds {
+			t.Errorf("credentials for %s = %+v, want %+v", stored.host, got, stored.creds)
+		}
+	}
+
+	f, err = LoadAuthFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, err := f.Erase(DockerHubHost); err != nil || !found {
+		t.Fatalf("erase = %v, %v", found, err)
+	}
+	if got, err := f.Get(DockerHubHost); err != nil || got != nil {
+		t.Errorf("after erase got %+v, %v", got, err)
+	}
+	// erasing again finds nothing, which is not an error
+	if found, err := f.Erase(DockerHubHost); err != nil || found {
+		t.Errorf("second erase = %v, %v", found, err)
+	}
+
+	want := []string{
+		// Set erases what was stored before storing
+		"erase https://index.docker.io/v1/",
+		"store https://index.docker.io/v1/",
+		"erase ghcr.io",
+		"store ghcr.io",
+		"get https://index.docker.io/v1/",
+		"get ghcr.io",
+		"erase https://index.docker.io/v1/",
+		"get https://index.docker.io/v1/",
+		"erase https://index.docker.io/v1/",
+	}
+	got := calls()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("helper calls:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCredentialHelperFallsBackToFile(t *testing.T) {
+	installStubHelper(t)
+	f, err := LoadAuthFile(AuthFilePath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// credentials stored before the helper was configured
+	if err := f.Set("registry.example.com", Credentials{Username: "old", Password: "pw"}); err != nil {
+		t.Fatal(err)
+	}
+	f.CredsStore = "stub"
+	got, err := f.Get("registry.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Username != "old" {
+		t.Errorf("got %+v, want the entry in the file", got)
+	}
+}
+
+func TestCredentialHelperErrors(t *testing.T) {
+	installStubHelper(t)
+	f, err := LoadAuthFile(AuthFilePath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.CredHelpers = map[string]string{"ghcr.io": "missing"}
+	if _, err := f.Get("ghcr.io"); err == nil || !strings.Contains(err.Error(), "docker-credential-missing not found in PATH") {
+		t.Errorf("missing helper: %v", err)
+	}
+
+	// the helper's own message is reported, as docker does
+	if _, err := credHelper("stub").run("list", strings.NewReader("")); err == nil || !strings.Contains(err.Error(), "docker-credential-stub list: unknown action list") {
+		t.Errorf("failing helper: %v", err)
+	}
+}
+
+func TestIdentityTokenThroughHelper(t *testing.T) {
+	installStubHelper(t)
+	store := os.Getenv("STUB_STORE")
+	f, err := LoadAuthFile(AuthFilePath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.CredsStore = "stub"
+	if err := f.Set("registry.example.com", Credentials{IdentityToken: "idtok"}); err != nil {
+		t.Fatal(err)
+	}
+	// stored the way docker stores them, so either can read the other's
+	entries, _ := filepath.Glob(filepath.Join(store, "[0-9]*"))
+	if len(entries) != 1 {
+		t.Fatalf("helper holds %q", entries)
+	}
+	data, _ := os.ReadFile(entries[0])
+	var stored helperCredentials
+	if err := json.Unmarshal(data, &stored); err != nil || stored.Username != "<token>" || stored.Secret != "idtok" {
+		t.Errorf("helper stored %s", data)
+	}
+
+	got, err := f.Get("registry.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Credentials{IdentityToken: "idtok"}); got == nil || *got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestIdentityTokenInAuthFile(t *testing.T) {
+	root := t.TempDir()
+	path := AuthFilePath(root)
+	auth := base64.StdEncoding.EncodeToString([]byte("ci:"))
+	if err := os.WriteFile(path, []byte(`{"auths":{
+		"registry.example.com":{"identitytoken":"idtok"},
+		"ghcr.io":{"auth":"`+auth+`","identitytoken":"ghtok"}
+	}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]Credentials{
+		"registry.example.com": {IdentityToken: "idtok"},
+		"ghcr.io":              {Username: "ci", IdentityToken: "ghtok"},
+	} {
+		got, err := LoadCredentials(root, host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil || *got != want {
+			t.Errorf("credentials for %s = %+v, want %+v", host, got, want)
+		}
+	}
+
+	// and written back under the same key
+	f, err := LoadAuthFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Set("quay.io", Credentials{IdentityToken: "qtok"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	var saved struct {
+		Auths map[string]map[string]string `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &saved); err != nil || len(saved.Auths["quay.io"]) != 1 || saved.Auths["quay.io"]["identitytoken"] != "qtok" {
+		t.Errorf("auth.json:\n%s", data)
+	}
+}
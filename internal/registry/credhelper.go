@@ -0,0 +1,95 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// credHelperPrefix is prepended to a credHelpers/credsStore name to find the
+// helper binary on PATH, e.g. "pass" runs docker-credential-pass.
+const credHelperPrefix = "docker-credential-"
+
+// identityTokenUser is the username helpers store an identity token under,
+// with the token as the secret.
+const identityTokenUser = "<token>"
+
+// errCredentialsNotFound is returned by a helper that has nothing stored for
+// the requested server.
+var errCredentialsNotFound = errors.New("credentials not found in native keychain")
+
+// helperCredentials is the JSON document exchanged with credential helpers.
+type helperCredentials struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+// credHelper runs a docker-credential-* binary using the protocol from
+// github.com/docker/docker-credential-helpers: the action is the only
+// argument, the request is written to stdin and the reply read from stdout.
+type credHelper string
+
+func (h credHelper) get(serverURL string) (*Credentials, error) {
+	out, err := h.run("get", strings.NewReader(serverURL))
+	if err != nil {
+		return nil, err
+	}
+	var reply helperCredentials
+	if err := json.Unmarshal(out, &reply); err != nil {
+		return nil, fmt.Errorf("%s%s get: invalid reply: %w", credHelperPrefix, h, err)
+	}
+	if reply.Username == identityTokenUser {
+		return &Credentials{IdentityToken: reply.Secret}, nil
+	}
+	return &Credentials{Username: reply.Username, Password: reply.Secret}, nil
+}
+
+func (h credHelper) store(serverURL string, creds Credentials) error {
+	stored := helperCredentials{ServerURL: serverURL, Username: creds.Username, Secret: creds.Password}
+	if creds.IdentityToken != "" {
+		stored.Username, stored.Secret = identityTokenUser, creds.IdentityToken
+	}
+	req, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	_, err = h.run("store", bytes.NewReader(req))
+	return err
+}
+
+func (h credHelper) erase(serverURL string) error {
+	_, err := h.run("erase", strings.NewReader(serverURL))
+	return err
+}
+
+func (h credHelper) run(action string, stdin io.Reader) ([]byte, error) {
+	name := credHelperPrefix + string(h)
+	cmd := exec.Command(name, action)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err == nil {
+		return out, nil
+	}
+	// helpers report errors on stdout; fall back to stderr for odd ones
+	msg := strings.TrimSpace(string(out))
+	if msg == "" {
+		msg = strings.TrimSpace(stderr.String())
+	}
+	if strings.Contains(msg, errCredentialsNotFound.Error()) {
+		return nil, errCredentialsNotFound
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, fmt.Errorf("credential helper %s not found in PATH", name)
+	}
+	if msg == "" {
+		msg = err.Error()
+	}
+	return nil, fmt.Errorf("%s %s: %s", name, action, msg)
+}
@@ -0,0 +1,77 @@
+package registry
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestGetBlobRange(t *testing.T) {
+	const blob = "0123456789"
+	tests := []struct {
+		name   string
+		answer int
+		want   string
+		err    error
+	}{
+		// the registry honours the Range header
+		{"partial content", http.StatusPartialContent, "56789", nil},
+		// or ignores it and sends the whole blob
+		{"whole blob", http.StatusOK, blob, nil},
+		// or the partial download is already complete
+		{"not satisfiable", http.StatusRequestedRangeNotSatisfiable, "", ErrRangeNotSatisfiable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v2/app/blobs/sha256:0" {
+					t.Errorf("requested %s", r.URL.Path)
+				}
+				if got := r.Header.Get("Range"); got != "bytes=5-" {
+					t.Errorf("Range = %q, want bytes=5-", got)
+				}
+				switch tt.answer {
+				case http.StatusPartialContent:
+					w.Header().Set("Content-Range", "bytes 5-9/10")
+					w.WriteHeader(tt.answer)
+					io.WriteString(w, blob[5:])
+				case http.StatusOK:
+					io.WriteString(w, blob)
+				default:
+					w.Header().Set("Content-Range", "bytes */10")
+					w.WriteHeader(tt.answer)
+				}
+			}), nil)
+			resp, err := c.GetBlob("app", "sha256:0", 5)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.answer {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.answer)
+			}
+			data, err := io.ReadAll(resp.Body)
+			if err != nil || string(data) != tt.want {
+				t.Errorf("body %q, %v; want %q", data, err, tt.want)
+			}
+		})
+	}
+
+	t.Run("no range from the start", func(t *testing.T) {
+		c, _ := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if got := r.Header.Get("Range"); got != "" {
+				t.Errorf("Range = %q for a fresh download", got)
+			}
+			io.WriteString(w, blob)
+		}), nil)
+		resp, err := c.GetBlob("app", "sha256:0", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	})
+}
@@ -0,0 +1,167 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error codes defined by the OCI distribution spec.
+const (
+	CodeBlobUnknown     = "BLOB_UNKNOWN"
+	CodeManifestUnknown = "MANIFEST_UNKNOWN"
+	CodeNameUnknown     = "NAME_UNKNOWN"
+	CodeUnauthorized    = "UNAUTHORIZED"
+	CodeDenied          = "DENIED"
+	CodeTooManyRequests = "TOOMANYREQUESTS"
+	CodeUnsupported     = "UNSUPPORTED"
+)
+
+const maxErrorBody = 64 << 10
+
+// ErrorDetail is one entry of the distribution error body
+// {"errors":[{"code":...,"message":...,"detail":...}]}.
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Detail  any    `json:"detail,omitempty"`
+}
+
+// Error is a failed registry response. Errors holds the decoded error body
+// when the registry sent one.
+type Error struct {
+	StatusCode int
+	Status     string
+	Errors     []ErrorDetail
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	var msg string
+	if len(e.Errors) == 0 {
+		msg = e.Status
+	} else {
+		parts := make([]string, 0, len(e.Errors))
+		for _, d := range e.Errors {
+			switch {
+			case d.Code == "":
+				parts = append(parts, d.Message)
+			case d.Message == "":
+				parts = append(parts, d.Code)
+			default:
+				parts = append(parts, d.Code+": "+d.Message)
+			}
+		}
+		msg = strings.Join(parts, "; ")
+	}
+	if e.RetryAfter > 0 {
+		msg += fmt.Sprintf(", retry in %s", e.RetryAfter.Round(time.Second))
+	}
+	return msg
+}
+
+// HasCode reports whether the registry returned the given error code.
+func (e *Error) HasCode(code string) bool {
+	for _, d := range e.Errors {
+		if d.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// newError builds an *Error from a non-success response and closes its body.
+func newError(resp *http.Response) *Error {
+	defer resp.Body.Close()
+	e := &Error{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	var payload struct {
+		Errors  []ErrorDetail `json:"errors"`
+		Details string        `json:"details"`
+	}
+	if json.Unmarshal(body, &payload) == nil {
+		e.Errors = payload.Errors
+		// token servers use {"details": "..."} instead
+		if len(e.Errors) == 0 && payload.Details != "" {
+			e.Errors = []ErrorDetail{{Message: payload.Details}}
+		}
+	}
+	if len(e.Errors) == 0 && resp.StatusCode == http.StatusTooManyRequests {
+		e.Errors = []ErrorDetail{{Code: CodeTooManyRequests, Message: "rate limit exceeded"}}
+	}
+	return e
+}
+
+// parseRetryAfter accepts both forms of the header: delay-seconds and an
+// HTTP date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// transportError is a failure to talk to the registry: a connection that
+// could not be made or broke, a timeout, or a body that stalled or was cut
+// short. The client wraps these where they happen, so Retryable does not
+// have to guess from the error type: a bare syscall.Errno from the local
+// disk or from unpacking a layer also satisfies net.Error.
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transportError) Unwrap() error {
+	return e.err
+}
+
+// asTransportError marks err as a transport failure, unless it came from a
+// local file, such as a blob being uploaded.
+func asTransportError(err error) error {
+	var pathErr *fs.PathError
+	if err == nil || errors.As(err, &pathErr) {
+		return err
+	}
+	return &transportError{err: err}
+}
+
+// Retryable reports whether err is worth retrying: connection problems,
+// timeouts, bodies cut short and 5xx/429 responses that the client has not
+// already retried. Anything else, in particular errors writing or
+// unpacking what was downloaded, fails the same way the next time.
+func Retryable(err error) bool {
+	var exhausted *exhaustedError
+	if err == nil || errors.As(err, &exhausted) {
+		return false
+	}
+	var regErr *Error
+	if errors.As(err, &regErr) {
+		if regErr.StatusCode == http.StatusTooManyRequests {
+			return regErr.RetryAfter <= maxRetryAfter
+		}
+		return regErr.StatusCode >= 500
+	}
+	var transportErr *transportError
+	return errors.As(err, &transportErr)
+}
@@ -0,0 +1,157 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"connection reset", &transportError{err: syscall.ECONNRESET}, true},
+		{"body cut short", fmt.Errorf("downloading blob: %w", &transportError{err: io.ErrUnexpectedEOF}), true},
+		{"server error", &Error{StatusCode: http.StatusServiceUnavailable}, true},
+		{"rate limited briefly", &Error{StatusCode: http.StatusTooManyRequests, RetryAfter: 5 * time.Second}, true},
+		{"rate limited for an hour", &Error{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Hour}, false},
+		{"not found", &Error{StatusCode: http.StatusNotFound}, false},
+		{"retries used up", &exhaustedError{attempts: MaxAttempts, err: &Error{StatusCode: http.StatusBadGateway}}, false},
+		// errors from unpacking a layer while it streams in
+		{"mknod without root", fmt.Errorf("create device dev/null: %w (run the command with sudo)", syscall.EPERM), false},
+		{"setxattr without root", fmt.Errorf("mark opaque directory etc: %w", syscall.EPERM), false},
+		{"hardlink", &os.LinkError{Op: "link", Old: "a", New: "b", Err: syscall.EEXIST}, false},
+		{"rename", &os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.EXDEV}, false},
+		{"disk full", &fs.PathError{Op: "write", Path: "blobs/x.partial", Err: syscall.ENOSPC}, false},
+		{"corrupt layer", fmt.Errorf("downloading blob: %w", io.ErrUnexpectedEOF), false},
+		{"local file in a transport error", asTransportError(&fs.PathError{Op: "read", Path: "blob", Err: syscall.EIO}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Retryable(tt.err); got != tt.want {
+				t.Errorf("Retryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlobBodyCutShortIsRetryable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "only ten b")
+		// the handler returning closes the connection 90 bytes early
+	}))
+	defer srv.Close()
+	c := NewClient(strings.TrimPrefix(srv.URL, "http://"), Options{})
+	resp, err := c.GetBlob("app", "sha256:0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	_, err = io.ReadAll(resp.Body)
+	if err == nil {
+		t.Fatal("reading a truncated body succeeded")
+	}
+	if !Retryable(err) {
+		t.Errorf("Retryable(%v) = false for a body cut short", err)
+	}
+	var transportErr *transportError
+	if !errors.As(err, &transportErr) {
+		t.Errorf("%v is not a transport error", err)
+	}
+}
+
+func TestTooManyRequests(t *testing.T) {
+	t.Run("retried after Retry-After", func(t *testing.T) {
+		var requests atomic.Int32
+		c, _ := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1) == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			io.WriteString(w, "{}")
+		}), nil)
+		start := time.Now()
+		if _, _, err := c.GetManifest("app", "1"); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed < time.Second {
+			t.Errorf("retried after %s, before Retry-After", elapsed)
+		}
+		if n := requests.Load(); n != 2 {
+			t.Errorf("%d requests, want 2", n)
+		}
+	})
+
+	t.Run("too long to wait", func(t *testing.T) {
+		var requests atomic.Int32
+		c, _ := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			io.WriteString(w, `{"errors":[{"code":"TOOMANYREQUESTS","message":"pull rate limit"}]}`)
+		}), nil)
+		_, _, err := c.GetManifest("app", "1")
+		var regErr *Error
+		if !errors.As(err, &regErr) || regErr.RetryAfter != time.Hour || !regErr.HasCode(CodeTooManyRequests) {
+			t.Fatalf("got %v, want the rate limit with its Retry-After", err)
+		}
+		if !strings.Contains(err.Error(), "retry in 1h0m0s") {
+			t.Errorf("%q does not say when to retry", err)
+		}
+		if Retryable(err) {
+			t.Error("an hour-long Retry-After is retryable")
+		}
+		if n := requests.Load(); n != 1 {
+			t.Errorf("%d requests, want 1", n)
+		}
+	})
+}
+
+func TestServerErrorsRetried(t *testing.T) {
+	var requests atomic.Int32
+	c, _ := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		io.WriteString(w, "{}")
+	}), nil)
+	if _, _, err := c.GetManifest("app", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("%d requests, want 3", n)
+	}
+}
+
+func TestClientErrorsNotRetried(t *testing.T) {
+	var requests atomic.Int32
+	c, _ := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+	}), nil)
+	_, _, err := c.GetManifest("app", "1")
+	var regErr *Error
+	if !errors.As(err, &regErr) || !regErr.HasCode(CodeManifestUnknown) {
+		t.Fatalf("got %v", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("%d requests, want 1", n)
+	}
+}
@@ -0,0 +1,247 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// UploadOptions configure UploadBlob.
+type UploadOptions struct {
+	// ChunkSize splits the upload into PATCH requests of at most this many
+	// bytes. Zero sends the whole blob in the PUT that closes the session.
+	ChunkSize int64
+
+	// Progress, if set, is called with the number of bytes sent so far.
+	Progress func(sent int64)
+}
+
+// BlobExists reports whether repo already has the blob with the given
+// digest.
+func (c *Client) BlobExists(repo, digest string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout*MaxAttempts)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "HEAD", c.url("/v2/%s/blobs/%s", repo, digest), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.doScope(req, pushScope(repo, ""))
+	if err != nil {
+		return false, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		resp.Body.Close()
+		return true, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return false, nil
+	}
+	return false, fmt.Errorf("check blob %s: %w", digest, newError(resp))
+}
+
+// MountBlob asks the registry to link the blob with the given digest from
+// the repository from, on the same registry, into repo instead of
+// receiving it again, and reports whether it did. A registry that declines
+// opens an upload session instead, which is cancelled.
+func (c *Client) MountBlob(repo, digest, from string) (bool, error) {
+	scope := pushScope(repo, from)
+	query := url.Values{"mount": {digest}, "from": {from}}
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout*MaxAttempts)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url("/v2/%s/blobs/uploads/", repo)+"?"+query.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.doScope(req, scope)
+	if err != nil {
+		return false, err
+	}
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		resp.Body.Close()
+		return true, nil
+	case http.StatusAccepted:
+		resp.Body.Close()
+	default:
+		return false, fmt.Errorf("mount %s from %s: %w", digest, from, newError(resp))
+	}
+	// registries expire abandoned sessions too, so a failure here is no
+	// reason to fail the push
+	if location, err := c.location(resp); err == nil {
+		if req, err := http.NewRequestWithContext(ctx, "DELETE", location, nil); err == nil {
+			if resp, err := c.doScope(req, scope); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}
+	return false, nil
+}
+
+// UploadBlob sends the size bytes of r as the blob with the given digest,
+// using the upload protocol of the distribution spec: a POST opens a
+// session, optional PATCH requests send chunks and a PUT with the digest
+// closes it. The registry checks the digest when the session is closed, so
+// a corrupt blob is rejected rather than stored.
+func (c *Client) UploadBlob(repo, digest string, size int64, r io.ReaderAt, opts *UploadOptions) error {
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	scope := pushScope(repo, "")
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout*MaxAttempts)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url("/v2/%s/blobs/uploads/", repo), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.doScope(req, scope)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("start upload of %s: %w", digest, newError(resp))
+	}
+	resp.Body.Close()
+	location, err := c.location(resp)
+	if err != nil {
+		return fmt.Errorf("start upload of %s: %w", digest, err)
+	}
+
+	var offset int64
+	if chunk := opts.ChunkSize; chunk > 0 {
+		if minChunk, err := strconv.ParseInt(resp.Header.Get("OCI-Chunk-Min-Length"), 10, 64); err == nil && minChunk > chunk {
+			chunk = minChunk
+		}
+		for offset < size {
+			n := min(chunk, size-offset)
+			req, err := newBodyRequest("PATCH", location, r, offset, n, opts.Progress)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+n-1))
+			resp, err := c.doScope(req, scope)
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != http.StatusAccepted {
+				return fmt.Errorf("upload chunk of %s at %d: %w", digest, offset, newError(resp))
+			}
+			resp.Body.Close()
+			if location, err = c.location(resp); err != nil {
+				return fmt.Errorf("upload chunk of %s: %w", digest, err)
+			}
+			offset += n
+		}
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("digest", digest)
+	u.RawQuery = q.Encode()
+	// with chunks everything has been sent and the PUT only closes the session
+	req, err = newBodyRequest("PUT", u.String(), r, offset, size-offset, opts.Progress)
+	if err != nil {
+		return err
+	}
+	resp, err = c.doScope(req, scope)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("upload of %s: %w", digest, newError(resp))
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// PutManifest stores data, a manifest or index of the given media type,
+// under ref (a tag or digest) and returns the digest the registry reports
+// for it.
+func (c *Client) PutManifest(repo, ref, mediaType string, data []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout*MaxAttempts)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "PUT", c.url("/v2/%s/manifests/%s", repo, ref), bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := c.doScope(req, pushScope(repo, ""))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("put manifest %s:%s: %w", repo, ref, newError(resp))
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Docker-Content-Digest"), nil
+}
+
+// pushScope is the token scope for writing to repo, plus read access to
+// the repository a blob is mounted from.
+func pushScope(repo, mountFrom string) string {
+	scope := fmt.Sprintf("repository:%s:pull,push", repo)
+	if mountFrom != "" {
+		scope += fmt.Sprintf(" repository:%s:pull", mountFrom)
+	}
+	return scope
+}
+
+// location returns the upload session URL from resp, which registries may
+// send relative to themselves.
+func (c *Client) location(resp *http.Response) (string, error) {
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return "", fmt.Errorf("%s did not return an upload location", c.Host)
+	}
+	base, err := url.Parse(c.url("/"))
+	if err != nil {
+		return "", err
+	}
+	u, err := base.Parse(loc)
+	if err != nil {
+		return "", fmt.Errorf("invalid upload location %q: %w", loc, err)
+	}
+	return u.String(), nil
+}
+
+// newBodyRequest builds a request whose body is n bytes of r from offset.
+// The body can be produced again, so send can retry the request.
+func newBodyRequest(method, location string, r io.ReaderAt, offset, n int64, progress func(int64)) (*http.Request, error) {
+	body := func() io.ReadCloser {
+		if n == 0 {
+			return http.NoBody
+		}
+		return io.NopCloser(&countingReader{r: io.NewSectionReader(r, offset, n), sent: offset, progress: progress})
+	}
+	req, err := http.NewRequestWithContext(context.Background(), method, location, body())
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = n
+	req.GetBody = func() (io.ReadCloser, error) { return body(), nil }
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return req, nil
+}
+
+// countingReader reports the running offset of an upload body.
+type countingReader struct {
+	r        io.Reader
+	sent     int64
+	progress func(int64)
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.sent += int64(n)
+	if cr.progress != nil && n > 0 {
+		cr.progress(cr.sent)
+	}
+	return n, err
+}
@@ -0,0 +1,270 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// uploadRegistry implements the blob upload endpoints of the distribution
+// spec in memory and records the requests it was sent.
+type uploadRegistry struct {
+	// minChunk, if set, is advertised as OCI-Chunk-Min-Length.
+	minChunk int
+
+	mu       sync.Mutex
+	blobs    map[string]string // "<repo>@<digest>" to content
+	sessions map[string]*strings.Builder
+	opened   int // sessions opened so far, for their ids
+	requests []string
+}
+
+func newUploadRegistry() *uploadRegistry {
+	return &uploadRegistry{blobs: make(map[string]string), sessions: make(map[string]*strings.Builder)}
+}
+
+func (u *uploadRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	repo, rest, _ := strings.Cut(path, "/blobs/")
+	u.requests = append(u.requests, r.Method+" "+strings.TrimPrefix(rest, "uploads/")+contentRange(r))
+
+	switch {
+	case r.Method == "HEAD":
+		if _, ok := u.blobs[repo+"@"+rest]; ok {
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+
+	case r.Method == "POST" && rest == "uploads/":
+		q := r.URL.Query()
+		if from := q.Get("from"); from != "" {
+			if data, ok := u.blobs[from+"@"+q.Get("mount")]; ok {
+				u.blobs[repo+"@"+q.Get("mount")] = data
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		id := strconv.Itoa(u.opened)
+		u.opened++
+		u.sessions[id] = &strings.Builder{}
+		if u.minChunk > 0 {
+			w.Header().Set("OCI-Chunk-Min-Length", strconv.Itoa(u.minChunk))
+		}
+		// relative, as distribution sends it
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id+"?state=0")
+		w.WriteHeader(http.StatusAccepted)
+
+	case strings.HasPrefix(rest, "uploads/"):
+		id := strings.TrimPrefix(rest, "uploads/")
+		session, ok := u.sessions[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == "DELETE" {
+			delete(u.sessions, id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if want := strconv.Itoa(session.Len()) + "-"; r.Method == "PATCH" && !strings.HasPrefix(r.Header.Get("Content-Range"), want) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		session.Write(data)
+		if r.Method == "PATCH" {
+			w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s?state=%d", repo, id, session.Len()))
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		digest := r.URL.Query().Get("digest")
+		if digest != sha256Digest(session.String()) {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"errors":[{"code":"DIGEST_INVALID","message":"provided digest did not match uploaded content"}]}`)
+			return
+		}
+		u.blobs[repo+"@"+digest] = session.String()
+		delete(u.sessions, id)
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func contentRange(r *http.Request) string {
+	if cr := r.Header.Get("Content-Range"); cr != "" {
+		return " " + cr
+	}
+	return ""
+}
+
+func sha256Digest(data string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(data)))
+}
+
+func TestUploadBlob(t *testing.T) {
+	const blob = "0123456789"
+	digest := sha256Digest(blob)
+	tests := []struct {
+		name      string
+		chunkSize int64
+		minChunk  int
+		requests  []string
+	}{
+		{"monolithic", 0, 0, []string{"POST ", "PUT 0"}},
+		{"chunked", 4, 0, []string{"POST ", "PATCH 0 0-3", "PATCH 0 4-7", "PATCH 0 8-9", "PUT 0"}},
+		{"chunks raised to the registry minimum", 4, 6, []string{"POST ", "PATCH 0 0-5", "PATCH 0 6-9", "PUT 0"}},
+		{"one chunk", 64, 0, []string{"POST ", "PATCH 0 0-9", "PUT 0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := newUploadRegistry()
+			reg.minChunk = tt.minChunk
+			c, _ := newTestClient(t, reg, nil)
+			var progress []int64
+			err := c.UploadBlob("app", digest, int64(len(blob)), strings.NewReader(blob), &UploadOptions{
+				ChunkSize: tt.chunkSize,
+				Progress:  func(sent int64) { progress = append(progress, sent) },
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := reg.blobs["app@"+digest]; got != blob {
+				t.Errorf("registry stored %q", got)
+			}
+			if strings.Join(reg.requests, ", ") != strings.Join(tt.requests, ", ") {
+				t.Errorf("requests %q, want %q", reg.requests, tt.requests)
+			}
+			if len(progress) == 0 || progress[len(progress)-1] != int64(len(blob)) {
+				t.Errorf("progress %v, want it to end at %d", progress, len(blob))
+			}
+		})
+	}
+}
+
+func TestMountBlob(t *testing.T) {
+	const blob = "shared base layer"
+	digest := sha256Digest(blob)
+
+	t.Run("mounted", func(t *testing.T) {
+		reg := newUploadRegistry()
+		reg.blobs["base@"+digest] = blob
+		c, _ := newTestClient(t, reg, nil)
+		mounted, err := c.MountBlob("app", digest, "base")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !mounted || reg.blobs["app@"+digest] != blob {
+			t.Errorf("mounted = %v, stored %q", mounted, reg.blobs["app@"+digest])
+		}
+		if len(reg.requests) != 1 {
+			t.Errorf("requests %q, want only the mount", reg.requests)
+		}
+	})
+
+	t.Run("declined", func(t *testing.T) {
+		// the source repository does not have it, so the registry opens an
+		// ordinary session, which is cancelled
+		reg := newUploadRegistry()
+		c, _ := newTestClient(t, reg, nil)
+		mounted, err := c.MountBlob("app", digest, "base")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mounted {
+			t.Error("reported a declined mount as mounted")
+		}
+		if _, ok := reg.blobs["app@"+digest]; ok {
+			t.Error("registry stored the blob")
+		}
+		if want := []string{"POST ", "DELETE 0"}; strings.Join(reg.requests, ", ") != strings.Join(want, ", ") {
+			t.Errorf("requests %q, want %q", reg.requests, want)
+		}
+		if len(reg.sessions) != 0 {
+			t.Errorf("%d upload sessions left open", len(reg.sessions))
+		}
+	})
+}
+
+func TestUploadBlobDigestMismatch(t *testing.T) {
+	reg := newUploadRegistry()
+	c, _ := newTestClient(t, reg, nil)
+	err := c.UploadBlob("app", sha256Digest("something else"), 4, strings.NewReader("blob"), nil)
+	if err == nil || !strings.Contains(err.Error(), "DIGEST_INVALID") {
+		t.Errorf("got %v, want the registry's digest error", err)
+	}
+	if len(reg.blobs) != 0 {
+		t.Errorf("registry stored %v", reg.blobs)
+	}
+}
+
+func TestBlobExists(t *testing.T) {
+	reg := newUploadRegistry()
+	digest := sha256Digest("layer")
+	reg.blobs["app@"+digest] = "layer"
+	c, _ := newTestClient(t, reg, nil)
+	for _, tt := range []struct {
+		repo string
+		want bool
+	}{{"app", true}, {"other", false}} {
+		exists, err := c.BlobExists(tt.repo, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != tt.want {
+			t.Errorf("BlobExists(%s) = %v, want %v", tt.repo, exists, tt.want)
+		}
+	}
+}
+
+func TestPutManifest(t *testing.T) {
+	const manifest = `{"schemaVersion":2}`
+	c, _ := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/v2/app/manifests/1" {
+			t.Errorf("%s %s", r.Method, r.URL.Path)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/vnd.oci.image.manifest.v1+json" {
+			t.Errorf("Content-Type %q", ct)
+		}
+		data, _ := io.ReadAll(r.Body)
+		w.Header().Set("Docker-Content-Digest", sha256Digest(string(data)))
+		w.WriteHeader(http.StatusCreated)
+	}), nil)
+	digest, err := c.PutManifest("app", "1", "application/vnd.oci.image.manifest.v1+json", []byte(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != sha256Digest(manifest) {
+		t.Errorf("digest %s, want %s", digest, sha256Digest(manifest))
+	}
+}
+
+func TestUploadRetriesChunk(t *testing.T) {
+	// a PATCH answered with a 503 is sent again with the same bytes
+	reg := newUploadRegistry()
+	failed := false
+	c, _ := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PATCH" && !failed {
+			failed = true
+			io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}), nil)
+	const blob = "0123456789"
+	if err := c.UploadBlob("app", sha256Digest(blob), int64(len(blob)), strings.NewReader(blob), &UploadOptions{ChunkSize: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if reg.blobs["app@"+sha256Digest(blob)] != blob {
+		t.Errorf("registry stored %q", reg.blobs["app@"+sha256Digest(blob)])
+	}
+}
@@ -3,23 +3,37 @@ package runtime
 import (
 	"encoding/json"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/harsha3330/crun/internal/config"
 	logger "github.com/harsha3330/crun/internal/log"
 	"github.com/harsha3330/crun/internal/pkg"
+	"github.com/harsha3330/crun/internal/reference"
 )
 
-// RemoveImage removes a pulled image: deletes its tag and manifest, then removes
-// blobs and extracted layers that are not referenced by any other image.
+// RemoveImage removes a pulled image: deletes its tag and the manifests of
+// every platform it was pulled for that no other tag, digest pin or
+// container uses, then removes blobs and extracted layers that are not
+// referenced by any other image or container.
 // It fails if any container is still using this image.
 func RemoveImage(cfg config.Config, stater logger.Console, image string) error {
-	repo, tag, err := parseImage(image)
+	ref, err := parseImage(image)
 	if err != nil {
 		stater.Error("invalid image", "error", err)
 		return err
 	}
+	image = ref.String()
+
+	// waits for pulls, pushes and runs, which may be using the blobs and
+	// layers about to be removed
+	locks, storeLock, err := lockStore(cfg, stater, true)
+	if err != nil {
+		return err
+	}
+	defer storeLock.Unlock()
 
 	// Refuse to remove if any container is using this image
 	if ids := containersUsingImage(cfg.RootDir, image); len(ids) > 0 {
@@ -27,8 +41,8 @@ func RemoveImage(cfg config.Config, stater logger.Console, image string) error {
 		return fmt.Errorf("image %s is in use by container %s (stop it first)", image, ids[0])
 	}
 
-	tagPath := filepath.Join(cfg.RootDir, "images", repo, "tags", tag)
-	digestData, err := os.ReadFile(tagPath)
+	tagFile := refPath(cfg.RootDir, ref)
+	entries, err := readRefFile(tagFile)
 	if err != nil {
 		if os.IsNotExist(err) {
 			stater.Error("image not found", "image", image)
@@ -37,18 +51,14 @@ func RemoveImage(cfg config.Config, stater logger.Console, image string) error {
 		stater.Error("failed to read tag file", "error", err)
 		return err
 	}
-	digest := string(digestData)
-	digestTrimmed := digest
-	if len(digestTrimmed) > 7 {
-		digestTrimmed = digestTrimmed[7:] // strip "sha256:"
-	}
-
-	manifestDir := filepath.Join(cfg.RootDir, "images", repo, "manifests", digestTrimmed)
-	manifestPath := filepath.Join(manifestDir, "manifest.json")
 
-	// Read manifest before deleting so we can remove blobs/layers not used by other images
+	// Read manifests before deleting so we can remove blobs/layers not used by other images
 	var digestsToMaybeRemove []string
-	if data, err := os.ReadFile(manifestPath); err == nil {
+	for _, entry := range entries {
+		data, err := os.ReadFile(manifestPath(cfg.RootDir, ref.Name(), entry.Manifest))
+		if err != nil {
+			continue
+		}
 		var m pkg.OCIManifest
 		if json.Unmarshal(data, &m) == nil {
 			if len(m.Config.Digest) > 7 {
@@ -62,17 +72,36 @@ func RemoveImage(cfg config.Config, stater logger.Console, image string) error {
 		}
 	}
 
-	if err := os.Remove(tagPath); err != nil {
+	if err := os.Remove(tagFile); err != nil {
 		stater.Error("failed to remove tag file", "error", err)
 		return err
 	}
-	if err := os.RemoveAll(manifestDir); err != nil {
-		stater.Error("failed to remove manifest dir", "error", err)
-		return err
+
+	// Other tags and digest pins may share the manifests, and containers
+	// keep the manifest they were started from after the tag moves on, in
+	// which case removing the tag is all there is to do
+	marks := newStoreMarks()
+	marks.markRefs(cfg.RootDir)
+	referenced := maps.Clone(marks.manifests)
+	marks.markContainers(cfg.RootDir)
+	for _, entry := range entries {
+		key := ref.Name() + "@" + entry.Manifest
+		if referenced[key] {
+			stater.Step("kept the manifest, other references still use it", "manifest", entry.Manifest)
+			continue
+		}
+		if marks.manifests[key] {
+			stater.Step("kept the manifest, a container still uses it", "manifest", entry.Manifest)
+			continue
+		}
+		if err := os.RemoveAll(manifestDir(cfg.RootDir, ref.Name(), entry.Manifest)); err != nil {
+			stater.Error("failed to remove manifest dir", "error", err)
+			return err
+		}
 	}
 
-	// Build set of digests still referenced by any remaining image
-	inUse := referencedDigests(cfg.RootDir)
+	// Build set of digests still referenced by any remaining image or container
+	inUse := marks.digests
 
 	blobDir := filepath.Join(cfg.RootDir, "blobs")
 	layerDir := filepath.Join(cfg.RootDir, "layers")
@@ -81,14 +110,17 @@ func RemoveImage(cfg config.Config, stater logger.Console, image string) error {
 			continue
 		}
 		_ = os.Remove(filepath.Join(blobDir, d))
-		_ = os.RemoveAll(filepath.Join(layerDir, d))
+		_ = pkg.RemoveLayer(filepath.Join(layerDir, d))
+		locks.Remove(pkg.BlobLock(d), pkg.LayerLock(d))
 	}
 
-	cleanEmptyParents(cfg.RootDir, repo)
+	cleanEmptyParents(cfg.RootDir, ref.Name())
 	stater.Success("image removed", "image", image)
 	return nil
 }
 
+// containersUsingImage returns the ids of containers started from image,
+// which must be in canonical form.
 func containersUsingImage(rootDir, image string) []string {
 	var ids []string
 	containersDir := filepath.Join(rootDir, "containers")
@@ -102,66 +134,80 @@ func containersUsingImage(rootDir, image string) []string {
 		if err != nil {
 			continue
 		}
-		if string(data) == image {
+		// containers started before references were canonicalized store the
+		// image as typed, so normalize before comparing
+		if ref, err := reference.Parse(string(data)); err == nil && ref.String() == image {
 			ids = append(ids, e.Name())
 		}
 	}
 	return ids
 }
 
-// referencedDigests returns a set (map) of all blob/layer digest suffixes (without "sha256:")
-// that are still referenced by any tag in images/.
-func referencedDigests(rootDir string) map[string]bool {
-	out := make(map[string]bool)
-	imagesDir := filepath.Join(rootDir, "images")
-	entries, _ := os.ReadDir(imagesDir)
+// storeMarks collects what is reachable in the store: manifests, keyed by
+// "<repository>@<digest>", and the blobs and layers they list, by hex.
+type storeMarks struct {
+	manifests map[string]bool
+	digests   map[string]bool
+}
+
+func newStoreMarks() *storeMarks {
+	return &storeMarks{manifests: make(map[string]bool), digests: make(map[string]bool)}
+}
+
+// markRefs marks what every tag and digest pin points at.
+func (m *storeMarks) markRefs(rootDir string) {
+	for _, name := range listRepositories(rootDir) {
+		for _, r := range listRefs(rootDir, name) {
+			m.markManifest(rootDir, name, r.Manifest)
+		}
+	}
+}
+
+// markContainers marks what every container directory runs on, running or
+// not, since a stopped one can be started again.
+func (m *storeMarks) markContainers(rootDir string) {
+	containersDir := filepath.Join(rootDir, "containers")
+	entries, _ := os.ReadDir(containersDir)
 	for _, e := range entries {
-		if !e.IsDir() {
-			continue
+		if e.IsDir() {
+			markContainer(rootDir, filepath.Join(containersDir, e.Name()), m)
 		}
-		tagsDir := filepath.Join(imagesDir, e.Name(), "tags")
-		tagEntries, _ := os.ReadDir(tagsDir)
-		for _, te := range tagEntries {
-			if te.IsDir() {
-				continue
-			}
-			tagPath := filepath.Join(tagsDir, te.Name())
-			data, err := os.ReadFile(tagPath)
-			if err != nil {
-				continue
-			}
-			digest := string(data)
-			trimmed := digest
-			if len(trimmed) > 7 {
-				trimmed = trimmed[7:]
-			}
-			manifestPath := filepath.Join(rootDir, "images", e.Name(), "manifests", trimmed, "manifest.json")
-			manifestData, err := os.ReadFile(manifestPath)
-			if err != nil {
-				continue
-			}
-			var m pkg.OCIManifest
-			if json.Unmarshal(manifestData, &m) != nil {
-				continue
-			}
-			if len(m.Config.Digest) > 7 {
-				out[m.Config.Digest[7:]] = true
-			}
-			for _, l := range m.Layers {
-				if len(l.Digest) > 7 {
-					out[l.Digest[7:]] = true
-				}
-			}
+	}
+}
+
+// markManifest marks a stored manifest and the config and layers it lists.
+func (m *storeMarks) markManifest(rootDir, name, digest string) {
+	m.manifests[name+"@"+digest] = true
+	manifestData, err := os.ReadFile(manifestPath(rootDir, name, digest))
+	if err != nil {
+		return
+	}
+	var manifest pkg.OCIManifest
+	if json.Unmarshal(manifestData, &manifest) != nil {
+		return
+	}
+	if len(manifest.Config.Digest) > 7 {
+		m.digests[manifest.Config.Digest[7:]] = true
+	}
+	for _, l := range manifest.Layers {
+		if len(l.Digest) > 7 {
+			m.digests[l.Digest[7:]] = true
 		}
 	}
-	return out
 }
 
-func cleanEmptyParents(rootDir, repo string) {
-	repoDir := filepath.Join(rootDir, "images", repo)
-	tagsDir := filepath.Join(repoDir, "tags")
-	manifestsDir := filepath.Join(repoDir, "manifests")
-	_ = os.Remove(tagsDir)       
-	_ = os.Remove(manifestsDir)  
-	_ = os.Remove(repoDir)      
+// cleanEmptyParents removes the repository's _tags/, _digests/ and
+// _manifests/ dirs and then every parent up to images/ that is left empty.
+func cleanEmptyParents(rootDir, name string) {
+	imagesDir := filepath.Join(rootDir, "images")
+	dir := repoDir(rootDir, name)
+	_ = os.Remove(filepath.Join(dir, tagsDir))
+	_ = os.Remove(filepath.Join(dir, digestsDir))
+	_ = os.Remove(filepath.Join(dir, manifestsDir))
+	for dir != imagesDir && strings.HasPrefix(dir, imagesDir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
 }
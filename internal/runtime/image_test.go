@@ -0,0 +1,72 @@
+package runtime
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/harsha3330/crun/internal/config"
+	logger "github.com/harsha3330/crun/internal/log"
+)
+
+func TestRemoveImageKeepsWhatContainersUse(t *testing.T) {
+	root := t.TempDir()
+	cfg := config.Config{RootDir: root}
+	repo := filepath.Join(root, "images/docker.io/library/app")
+	oldHex, newHex := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	configHex, layerHex, newLayerHex := strings.Repeat("c", 64), strings.Repeat("d", 64), strings.Repeat("e", 64)
+	manifest := func(layer string) string {
+		return `{"schemaVersion":2,"config":{"digest":"sha256:` + configHex + `"},"layers":[{"digest":"sha256:` + layer + `"}]}`
+	}
+
+	// the container was started from app:1, which has been pulled again
+	// since; the manifest it runs is still pinned by digest
+	writeStoreFile(t, filepath.Join(repo, tagsDir, "1"), "linux/amd64 sha256:"+newHex)
+	writeStoreFile(t, filepath.Join(repo, digestsDir, oldHex), "linux/amd64 sha256:"+oldHex)
+	writeStoreFile(t, filepath.Join(repo, manifestsDir, oldHex, "manifest.json"), manifest(layerHex))
+	writeStoreFile(t, filepath.Join(repo, manifestsDir, newHex, "manifest.json"), manifest(newLayerHex))
+	for _, hex := range []string{configHex, layerHex, newLayerHex} {
+		writeStoreFile(t, filepath.Join(root, "blobs", hex), hex)
+	}
+	writeStoreFile(t, filepath.Join(root, "layers", layerHex, "bin/sh"), "sh")
+	writeStoreFile(t, filepath.Join(root, "layers", newLayerHex, "bin/sh"), "sh")
+	container := filepath.Join(root, "containers/0123456789ab")
+	writeStoreFile(t, filepath.Join(container, "image"), "docker.io/library/app:1")
+	writeStoreFile(t, filepath.Join(container, "manifest"), "docker.io/library/app@sha256:"+oldHex)
+
+	if err := RemoveImage(cfg, logger.Console{}, "app@sha256:"+oldHex); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(repo, digestsDir, oldHex)); !os.IsNotExist(err) {
+		t.Errorf("the digest pin was not removed: %v", err)
+	}
+	for _, path := range []string{
+		filepath.Join(repo, manifestsDir, oldHex, "manifest.json"),
+		filepath.Join(root, "blobs", layerHex),
+		filepath.Join(root, "layers", layerHex, "bin/sh"),
+		filepath.Join(root, "blobs", configHex),
+	} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("removed what the container runs: %v", err)
+		}
+	}
+
+	// once the container is gone, prune removes the manifest it left dangling
+	if err := os.RemoveAll(container); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Prune(cfg, slog.New(slog.DiscardHandler), logger.Console{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{
+		filepath.Join(repo, manifestsDir, oldHex),
+		filepath.Join(root, "blobs", layerHex),
+		filepath.Join(root, "layers", layerHex),
+	} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("prune left %s: %v", path, err)
+		}
+	}
+}
@@ -18,6 +18,7 @@ func Init(cfg *config.Config, logOpts *logger.LogOptions, log *slog.Logger, stat
 		filepath.Join(cfg.RootDir, "containers"),
 		filepath.Join(cfg.RootDir, "layers"),
 		filepath.Join(cfg.RootDir, "blobs"),
+		filepath.Join(cfg.RootDir, "locks"),
 	}
 
 	for _, dir := range dirs {
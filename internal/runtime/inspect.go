@@ -0,0 +1,141 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/harsha3330/crun/internal/config"
+	logger "github.com/harsha3330/crun/internal/log"
+	"github.com/harsha3330/crun/internal/pkg"
+)
+
+type InspectOptions struct {
+	// Platform picks which of the platforms the image was pulled for to
+	// inspect; empty means the one closest to this host.
+	Platform string
+}
+
+// ImageDetails is everything the store knows about one pulled image.
+type ImageDetails struct {
+	Reference string       `json:"reference"`
+	Digest    string       `json:"digest"`
+	ID        string       `json:"id"`
+	Platform  pkg.Platform `json:"platform"`
+	// Size is what the config and layers take to download, UnpackedSize
+	// what the layers take once unpacked.
+	Size         int64              `json:"size"`
+	UnpackedSize int64              `json:"unpackedSize"`
+	Layers       []LayerDetails     `json:"layers"`
+	Manifest     pkg.OCIManifest    `json:"manifest"`
+	Config       pkg.OCIImageConfig `json:"config"`
+	// Metadata is nil for images pulled before it was recorded.
+	Metadata *ImageMetadata `json:"metadata,omitempty"`
+}
+
+// LayerDetails joins what the manifest and the config say about a layer,
+// bottom layer first.
+type LayerDetails struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	// DiffID is the digest of the uncompressed layer, from the config.
+	DiffID       string `json:"diffID,omitempty"`
+	UnpackedSize int64  `json:"unpackedSize"`
+	// Path is where the layer is unpacked; empty if it is missing.
+	Path string `json:"path,omitempty"`
+	// CreatedBy is the build step that produced the layer.
+	CreatedBy string `json:"createdBy,omitempty"`
+}
+
+// ImageInspect gathers the manifest, config, layers and pull metadata of a
+// pulled image.
+func ImageInspect(cfg config.Config, stater logger.Console, image string, opts *InspectOptions) (*ImageDetails, error) {
+	if opts == nil {
+		opts = &InspectOptions{}
+	}
+	ref, err := parseImage(image)
+	if err != nil {
+		stater.Error(err.Error())
+		return nil, err
+	}
+	platform := pkg.HostPlatform()
+	if opts.Platform != "" {
+		if platform, err = pkg.ParsePlatform(opts.Platform); err != nil {
+			stater.Error(err.Error())
+			return nil, err
+		}
+	}
+	_, storeLock, err := lockStore(cfg, stater, false)
+	if err != nil {
+		return nil, err
+	}
+	defer storeLock.Unlock()
+	digest, err := resolveImage(cfg.RootDir, ref, platform)
+	if err != nil {
+		stater.Error("image not available locally", "image", ref.String(), "error", err)
+		return nil, err
+	}
+	data, err := os.ReadFile(manifestPath(cfg.RootDir, ref.Name(), digest))
+	if err != nil {
+		stater.Error("failed to read the image manifest", "manifest", digest, "error", err)
+		return nil, err
+	}
+	manifest, err := pkg.DecodeManifestAuto(data)
+	if err != nil {
+		stater.Error("error decoding the image manifest", "manifest", digest, "error", err)
+		return nil, err
+	}
+	blobDir := filepath.Join(cfg.RootDir, "blobs")
+	configData, err := os.ReadFile(filepath.Join(blobDir, strings.TrimPrefix(manifest.Config.Digest, "sha256:")))
+	if err != nil {
+		stater.Error("failed to read the image config", "digest", manifest.Config.Digest, "error", err)
+		return nil, err
+	}
+	details := &ImageDetails{
+		Reference: ref.String(),
+		Digest:    digest,
+		ID:        manifest.Config.Digest,
+		Manifest:  *manifest,
+		Size:      manifest.Config.Size,
+	}
+	if err := json.Unmarshal(configData, &details.Config); err != nil {
+		stater.Error("error decoding the image config", "digest", manifest.Config.Digest, "error", err)
+		return nil, fmt.Errorf("decode image config: %w", err)
+	}
+	imageConfig := &details.Config
+	details.Platform = pkg.NormalizePlatform(pkg.Platform{OS: imageConfig.OS, Arch: imageConfig.Architecture, Variant: imageConfig.Variant})
+
+	// history has an entry for every build step, and only the ones that
+	// are not empty layers line up with the manifest's layers
+	var createdBy []string
+	for _, h := range imageConfig.History {
+		if !h.EmptyLayer {
+			createdBy = append(createdBy, h.CreatedBy)
+		}
+	}
+	for i, l := range manifest.Layers {
+		layer := LayerDetails{Digest: l.Digest, MediaType: l.MediaType, Size: l.Size}
+		if i < len(imageConfig.RootFS.DiffIDs) {
+			layer.DiffID = imageConfig.RootFS.DiffIDs[i]
+		}
+		if i < len(createdBy) {
+			layer.CreatedBy = createdBy[i]
+		}
+		path := filepath.Join(cfg.RootDir, "layers", strings.TrimPrefix(l.Digest, "sha256:"))
+		if _, err := os.Stat(path); err == nil {
+			layer.Path = path
+			layer.UnpackedSize = dirSize(path)
+		}
+		details.Size += l.Size
+		details.UnpackedSize += layer.UnpackedSize
+		details.Layers = append(details.Layers, layer)
+	}
+
+	if details.Metadata, err = readMetadata(cfg.RootDir, ref.Name(), digest); err != nil {
+		stater.Warn("failed to read the image metadata", "error", err)
+	}
+	return details, nil
+}
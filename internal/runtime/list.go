@@ -1,48 +1,307 @@
 package runtime
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/harsha3330/crun/internal/config"
 	logger "github.com/harsha3330/crun/internal/log"
+	"github.com/harsha3330/crun/internal/pkg"
+	"github.com/harsha3330/crun/internal/reference"
 )
 
-// ImageList returns all pulled images as "repo:tag" (e.g. "nginx:1-alpine-perl").
-func ImageList(cfg config.Config, stater logger.Console) ([]string, error) {
+// ImageInfo holds one row for image list, one per platform a reference was
+// pulled for. Tag is empty for images pulled by digest; Digest is the
+// pinned digest for those and the platform manifest digest for tags.
+// Manifests that no tag or digest points at any more, such as the one a
+// tag resolved to before it was pulled again, are listed as dangling, with
+// no tag and their own digest.
+type ImageInfo struct {
+	Repository string       `json:"repository"`
+	Tag        string       `json:"tag,omitempty"`
+	Digest     string       `json:"digest"`
+	Manifest   string       `json:"manifest"`
+	ID         string       `json:"id"`
+	Platform   pkg.Platform `json:"platform"`
+	// Created is zero when the image config does not record it.
+	Created time.Time `json:"created,omitzero"`
+	// Size is what the config and layers take to download, UnpackedSize
+	// what the layers take once unpacked.
+	Size         int64 `json:"size"`
+	UnpackedSize int64 `json:"unpackedSize"`
+	Layers       int   `json:"layers"`
+	Dangling     bool  `json:"dangling"`
+}
+
+// Reference returns the canonical reference the image can be used by
+// (e.g. "docker.io/library/nginx:1-alpine-perl" or "...@sha256:...").
+func (i ImageInfo) Reference() string {
+	if i.Tag != "" {
+		return i.Repository + ":" + i.Tag
+	}
+	return i.Repository + "@" + i.Digest
+}
+
+// ShortID returns the first 12 hex digits of the image ID, as image tables
+// show it.
+func (i ImageInfo) ShortID() string {
+	id := strings.TrimPrefix(i.ID, "sha256:")
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return id
+}
+
+// ImageList returns all pulled images, by tag and by pinned digest, and
+// the dangling ones.
+func ImageList(cfg config.Config, stater logger.Console) ([]ImageInfo, error) {
 	imagesDir := filepath.Join(cfg.RootDir, "images")
-	entries, err := os.ReadDir(imagesDir)
-	if err != nil {
+	if _, err := os.Stat(imagesDir); err != nil {
 		if os.IsNotExist(err) {
 			return nil, nil
 		}
 		stater.Error("failed to read images dir", "error", err)
 		return nil, err
 	}
-	var out []string
-	for _, e := range entries {
-		if !e.IsDir() {
-			continue
+	_, storeLock, err := lockStore(cfg, stater, false)
+	if err != nil {
+		return nil, err
+	}
+	defer storeLock.Unlock()
+	// layers are shared between images, so each is measured once
+	unpacked := make(map[string]int64)
+	var out []ImageInfo
+	for _, name := range listRepositories(cfg.RootDir) {
+		referenced := make(map[string]bool)
+		for _, r := range listRefs(cfg.RootDir, name) {
+			info := ImageInfo{Repository: name, Tag: r.Tag, Digest: r.Digest, Manifest: r.Manifest, Platform: r.Platform}
+			if info.Digest == "" {
+				info.Digest = r.Manifest
+			}
+			describeImage(cfg.RootDir, &info, unpacked)
+			referenced[r.Manifest] = true
+			out = append(out, info)
 		}
-		repo := e.Name()
-		tagsDir := filepath.Join(imagesDir, repo, "tags")
-		tagEntries, err := os.ReadDir(tagsDir)
-		if err != nil {
-			if os.IsNotExist(err) {
+		entries, _ := os.ReadDir(filepath.Join(repoDir(cfg.RootDir, name), manifestsDir))
+		for _, e := range entries {
+			digest := "sha256:" + e.Name()
+			if !e.IsDir() || referenced[digest] {
 				continue
 			}
+			info := ImageInfo{Repository: name, Digest: digest, Manifest: digest, Dangling: true}
+			if platform, err := manifestPlatform(cfg.RootDir, name, digest); err == nil {
+				info.Platform = platform
+			}
+			describeImage(cfg.RootDir, &info, unpacked)
+			out = append(out, info)
+		}
+	}
+	return out, nil
+}
+
+// describeImage fills in what the manifest and config of info say about
+// it. Whatever cannot be read is left zero, so a damaged image still lists.
+func describeImage(rootDir string, info *ImageInfo, unpacked map[string]int64) {
+	data, err := os.ReadFile(manifestPath(rootDir, info.Repository, info.Manifest))
+	if err != nil {
+		return
+	}
+	manifest, err := pkg.DecodeManifestAuto(data)
+	if err != nil {
+		return
+	}
+	info.ID = manifest.Config.Digest
+	info.Layers = len(manifest.Layers)
+	info.Size = manifest.Config.Size
+	for _, l := range manifest.Layers {
+		info.Size += l.Size
+		hex := strings.TrimPrefix(l.Digest, "sha256:")
+		n, ok := unpacked[hex]
+		if !ok {
+			n = dirSize(filepath.Join(rootDir, "layers", hex))
+			unpacked[hex] = n
+		}
+		info.UnpackedSize += n
+	}
+	configData, err := os.ReadFile(filepath.Join(rootDir, "blobs", strings.TrimPrefix(manifest.Config.Digest, "sha256:")))
+	if err != nil {
+		return
+	}
+	var imageConfig pkg.OCIImageConfig
+	if json.Unmarshal(configData, &imageConfig) == nil {
+		if created, err := time.Parse(time.RFC3339Nano, imageConfig.Created); err == nil {
+			info.Created = created
+		}
+	}
+}
+
+// dirSize returns the bytes of the regular files under dir, or zero if it
+// cannot be read.
+func dirSize(dir string) int64 {
+	var n int64
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			n += info.Size()
+		}
+		return nil
+	})
+	return n
+}
+
+// ImageFilter selects images for image list, as parsed from --filter
+// values by ParseImageFilters. Empty fields select everything.
+type ImageFilter struct {
+	// References are glob patterns (path.Match) for the repository or
+	// repository:tag, in canonical form or as commonly written, so
+	// "nginx*" matches docker.io/library/nginx:latest. An image matching
+	// any of them is selected.
+	References []string
+	// Dangling selects only dangling images if true and hides them if false.
+	Dangling *bool
+	// Before and Since name an image, by reference or ID, and select the
+	// images created before or after it.
+	Before string
+	Since  string
+}
+
+// ParseImageFilters parses "key=value" filters, several of which may be
+// given in one comma-separated value: reference=<pattern> (repeatable),
+// dangling=true|false, before=<image> and since=<image>.
+func ParseImageFilters(values []string) (ImageFilter, error) {
+	var f ImageFilter
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+			if !ok || value == "" {
+				return f, fmt.Errorf("invalid filter %q: expected key=value", item)
+			}
+			switch key {
+			case "reference":
+				if _, err := path.Match(value, ""); err != nil {
+					return f, fmt.Errorf("invalid reference filter %q: %w", value, err)
+				}
+				f.References = append(f.References, value)
+			case "dangling":
+				dangling, err := strconv.ParseBool(value)
+				if err != nil {
+					return f, fmt.Errorf("invalid dangling filter %q: expected true or false", value)
+				}
+				f.Dangling = &dangling
+			case "before":
+				f.Before = value
+			case "since":
+				f.Since = value
+			default:
+				return f, fmt.Errorf("unknown filter %q (supported: reference, dangling, before, since)", key)
+			}
+		}
+	}
+	return f, nil
+}
+
+// Select returns the images the filter selects. The images Before and
+// Since name are looked up among images, and images without a creation
+// time are left out when either is set.
+func (f ImageFilter) Select(images []ImageInfo) ([]ImageInfo, error) {
+	var before, since time.Time
+	for _, bound := range []struct {
+		image string
+		t     *time.Time
+	}{{f.Before, &before}, {f.Since, &since}} {
+		if bound.image == "" {
 			continue
 		}
-		for _, te := range tagEntries {
-			if te.IsDir() {
+		img, ok := findImage(images, bound.image)
+		if !ok {
+			return nil, fmt.Errorf("no such image: %s", bound.image)
+		}
+		if img.Created.IsZero() {
+			return nil, fmt.Errorf("image %s records no creation time", bound.image)
+		}
+		*bound.t = img.Created
+	}
+	var out []ImageInfo
+	for _, info := range images {
+		if !f.Match(info) {
+			continue
+		}
+		if (!before.IsZero() || !since.IsZero()) && info.Created.IsZero() {
+			continue
+		}
+		if !before.IsZero() && !info.Created.Before(before) || !since.IsZero() && !info.Created.After(since) {
+			continue
+		}
+		out = append(out, info)
+	}
+	return out, nil
+}
+
+// findImage returns the image in images that image names, as a reference
+// or a prefix of its ID.
+func findImage(images []ImageInfo, image string) (ImageInfo, bool) {
+	if ref, err := reference.Parse(image); err == nil {
+		for _, info := range images {
+			if info.Repository != ref.Name() {
 				continue
 			}
-			out = append(out, repo+":"+te.Name())
+			if ref.Digest != "" && (info.Digest == ref.Digest || info.Manifest == ref.Digest) ||
+				ref.Digest == "" && info.Tag == ref.Tag {
+				return info, true
+			}
 		}
 	}
-	return out, nil
+	id := strings.TrimPrefix(image, "sha256:")
+	for _, info := range images {
+		if info.ID != "" && strings.HasPrefix(strings.TrimPrefix(info.ID, "sha256:"), id) {
+			return info, true
+		}
+	}
+	return ImageInfo{}, false
+}
+
+// Match reports whether the reference and dangling filters select info.
+func (f ImageFilter) Match(info ImageInfo) bool {
+	if f.Dangling != nil && info.Dangling != *f.Dangling {
+		return false
+	}
+	if len(f.References) == 0 {
+		return true
+	}
+	var names []string
+	for _, name := range []string{info.Repository, familiarName(info.Repository)} {
+		names = append(names, name)
+		if info.Tag != "" {
+			names = append(names, name+":"+info.Tag)
+		}
+	}
+	for _, pattern := range f.References {
+		for _, name := range names {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// familiarName shortens a canonical repository name the way it is usually
+// typed: docker.io/library/nginx is nginx and docker.io/org/app is org/app.
+func familiarName(name string) string {
+	if rest, ok := strings.CutPrefix(name, reference.DefaultDomain+"/"); ok {
+		return strings.TrimPrefix(rest, "library/")
+	}
+	return name
 }
 
 // ContainerInfo holds one row for container list.
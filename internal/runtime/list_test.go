@@ -0,0 +1,111 @@
+package runtime
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseImageFilters(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		values []string
+		want   ImageFilter
+		err    string
+	}{
+		{nil, ImageFilter{}, ""},
+		{[]string{"dangling=true"}, ImageFilter{Dangling: &yes}, ""},
+		{[]string{"dangling=false"}, ImageFilter{Dangling: &no}, ""},
+		{[]string{"dangling=1"}, ImageFilter{Dangling: &yes}, ""},
+		{[]string{"dangling="}, ImageFilter{}, "expected key=value"},
+		{[]string{"dangling=maybe"}, ImageFilter{}, "expected true or false"},
+		{[]string{"reference=nginx:*"}, ImageFilter{References: []string{"nginx:*"}}, ""},
+		{[]string{"reference=nginx", "reference=ghcr.io/*/app"}, ImageFilter{References: []string{"nginx", "ghcr.io/*/app"}}, ""},
+		{[]string{"reference=a, dangling=false"}, ImageFilter{References: []string{"a"}, Dangling: &no}, ""},
+		{[]string{"reference=[a"}, ImageFilter{}, "invalid reference filter"},
+		{[]string{"before=nginx:1"}, ImageFilter{Before: "nginx:1"}, ""},
+		{[]string{"since=sha256:abcd,before=alpine"}, ImageFilter{Since: "sha256:abcd", Before: "alpine"}, ""},
+		{[]string{"since="}, ImageFilter{}, "expected key=value"},
+		{[]string{"label=a"}, ImageFilter{}, `unknown filter "label"`},
+		{[]string{"dangling"}, ImageFilter{}, "expected key=value"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.values, " "), func(t *testing.T) {
+			got, err := ParseImageFilters(tt.values)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got %v, want an error about %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageFilterSelect(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+	dangling := "sha256:" + strings.Repeat("d", 64)
+	images := []ImageInfo{
+		{Repository: "docker.io/library/nginx", Tag: "1", ID: "sha256:1111", Created: day(1)},
+		{Repository: "docker.io/library/nginx", Tag: "2", ID: "sha256:2222", Created: day(2)},
+		{Repository: "docker.io/library/alpine", Tag: "3.19", ID: "sha256:3333", Created: day(3)},
+		{Repository: "ghcr.io/org/app", Tag: "v1", ID: "sha256:4444", Created: day(4)},
+		{Repository: "docker.io/library/nginx", Digest: dangling, ID: "sha256:5555", Created: day(5), Dangling: true},
+		{Repository: "docker.io/library/busybox", Tag: "old", ID: "sha256:6666"},
+	}
+	tests := []struct {
+		filter []string
+		want   []string
+		err    string
+	}{
+		{nil, []string{"1111", "2222", "3333", "4444", "5555", "6666"}, ""},
+		{[]string{"dangling=true"}, []string{"5555"}, ""},
+		{[]string{"dangling=false"}, []string{"1111", "2222", "3333", "4444", "6666"}, ""},
+		{[]string{"reference=nginx"}, []string{"1111", "2222", "5555"}, ""},
+		{[]string{"reference=nginx:2"}, []string{"2222"}, ""},
+		{[]string{"reference=docker.io/library/nginx:*"}, []string{"1111", "2222"}, ""},
+		{[]string{"reference=*"}, []string{"1111", "2222", "3333", "5555", "6666"}, ""},
+		{[]string{"reference=*/*/*"}, []string{"1111", "2222", "3333", "4444", "5555", "6666"}, ""},
+		{[]string{"reference=ghcr.io/*/app", "reference=alpine"}, []string{"3333", "4444"}, ""},
+		{[]string{"before=alpine:3.19"}, []string{"1111", "2222"}, ""},
+		{[]string{"since=nginx:2"}, []string{"3333", "4444", "5555"}, ""},
+		{[]string{"since=1111,before=4444"}, []string{"2222", "3333"}, ""},
+		{[]string{"since=sha256:2222,dangling=false"}, []string{"3333", "4444"}, ""},
+		{[]string{"before=nginx@" + dangling + ",reference=nginx"}, []string{"1111", "2222"}, ""},
+		{[]string{"since=nginx:3"}, nil, "no such image: nginx:3"},
+		{[]string{"before=busybox:old"}, nil, "no creation time"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.filter, " "), func(t *testing.T) {
+			f, err := ParseImageFilters(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			selected, err := f.Select(images)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got %v, want an error about %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, img := range selected {
+				got = append(got, strings.TrimPrefix(img.ID, "sha256:"))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("selected %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
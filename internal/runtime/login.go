@@ -0,0 +1,72 @@
+package runtime
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/harsha3330/crun/internal/config"
+	logger "github.com/harsha3330/crun/internal/log"
+	"github.com/harsha3330/crun/internal/registry"
+)
+
+// Login verifies creds against the registry's /v2/ endpoint and, if they
+// are accepted, saves them for pulls from host: in the credential helper
+// configured in RootDir/auth.json, or in that file itself.
+func Login(cfg config.Config, log *slog.Logger, stater logger.Console, host string, creds registry.Credentials) error {
+	host = registry.NormalizeHost(host)
+	if creds.Username == "" || creds.Password == "" {
+		return fmt.Errorf("username and password are required")
+	}
+
+	stater.Step("verifying credentials", "registry", host, "username", creds.Username)
+	client := registry.NewClient(host, registry.Options{Credentials: &creds})
+	if err := client.Ping(); err != nil {
+		log.Error("login failed", "registry", host, "username", creds.Username, "error", err)
+		stater.Error("login failed", "registry", host, "error", err)
+		return fmt.Errorf("login to %s failed: %w", host, err)
+	}
+
+	path := registry.AuthFilePath(cfg.RootDir)
+	authFile, err := registry.LoadAuthFile(path)
+	if err != nil {
+		stater.Error("failed to read credential store", "path", path, "error", err)
+		return err
+	}
+	if err := authFile.Set(host, creds); err != nil {
+		stater.Error("failed to store credentials", "registry", host, "error", err)
+		return err
+	}
+	if err := authFile.Save(); err != nil {
+		stater.Error("failed to save credentials", "path", path, "error", err)
+		return err
+	}
+	log.Info("login succeeded", "registry", host, "username", creds.Username)
+	stater.Success("login succeeded", "registry", host, "credentials", path)
+	return nil
+}
+
+// Logout removes the stored credentials for host.
+func Logout(cfg config.Config, stater logger.Console, host string) error {
+	host = registry.NormalizeHost(host)
+	path := registry.AuthFilePath(cfg.RootDir)
+	authFile, err := registry.LoadAuthFile(path)
+	if err != nil {
+		stater.Error("failed to read credential store", "path", path, "error", err)
+		return err
+	}
+	found, err := authFile.Erase(host)
+	if err != nil {
+		stater.Error("failed to remove credentials", "registry", host, "error", err)
+		return err
+	}
+	if !found {
+		stater.Warn("not logged in", "registry", host)
+		return nil
+	}
+	if err := authFile.Save(); err != nil {
+		stater.Error("failed to save credential store", "path", path, "error", err)
+		return err
+	}
+	stater.Success("removed login credentials", "registry", host)
+	return nil
+}
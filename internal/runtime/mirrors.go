@@ -0,0 +1,81 @@
+package runtime
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/harsha3330/crun/internal/config"
+	logger "github.com/harsha3330/crun/internal/log"
+	"github.com/harsha3330/crun/internal/pkg"
+	"github.com/harsha3330/crun/internal/registry"
+)
+
+// registryClients returns a client for every endpoint serving domain, in
+// the order a pull tries them: the mirrors configured for it under
+// [Registries] in config.toml, then the registry itself. Several keys can
+// name the same registry, such as docker.io and index.docker.io; their
+// mirrors are taken in the order of the keys.
+func registryClients(cfg config.Config, domain string) ([]*registry.Client, error) {
+	var clients []*registry.Client
+	for _, key := range slices.Sorted(maps.Keys(cfg.Registries)) {
+		if registry.NormalizeHost(key) != domain {
+			continue
+		}
+		regCfg := cfg.Registries[key]
+		for _, mirror := range regCfg.Mirrors {
+			host := mirror.Endpoint
+			plainHTTP := mirror.Insecure || strings.HasPrefix(host, "http://")
+			host = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://"), "/")
+			if host == "" {
+				return nil, fmt.Errorf("registry %s: mirror without an endpoint", key)
+			}
+			tlsConfig, err := registry.TLSConfig(mirror.CAFile, mirror.SkipVerify)
+			if err != nil {
+				return nil, fmt.Errorf("mirror %s: %w", host, err)
+			}
+			creds, err := registry.LoadCredentials(cfg.RootDir, host)
+			if err != nil {
+				return nil, err
+			}
+			clients = append(clients, registry.NewClient(host, registry.Options{
+				Credentials: creds,
+				PlainHTTP:   plainHTTP,
+				TLSConfig:   tlsConfig,
+			}))
+		}
+	}
+	creds, err := registry.LoadCredentials(cfg.RootDir, domain)
+	if err != nil {
+		return nil, err
+	}
+	return append(clients, registry.NewClient(domain, registry.Options{Credentials: creds})), nil
+}
+
+// fetchManifest gets repo:ref from the first endpoint that has it and
+// returns it with its content type and the index of that endpoint. With a
+// non-empty digest, content that does not match it counts as a failure of
+// that endpoint.
+func fetchManifest(clients []*registry.Client, repo, ref, digest string, log *slog.Logger, stater logger.Console) ([]byte, string, int, error) {
+	var lastErr error
+	for i, client := range clients {
+		data, contentType, err := client.GetManifest(repo, ref)
+		if err == nil && digest != "" {
+			if verr := pkg.VerifyDigest(data, digest); verr != nil {
+				err = fmt.Errorf("%s returned content that does not match %s: %w", client.Host, digest, verr)
+			}
+		}
+		if err == nil {
+			log.Info("fetched manifest", "endpoint", client.Host, "repository", repo, "reference", ref)
+			return data, contentType, i, nil
+		}
+		lastErr = err
+		if i < len(clients)-1 {
+			log.Warn("registry endpoint failed, trying next", "endpoint", client.Host, "reference", ref, "error", err)
+			stater.Warn("registry endpoint failed, trying next", "endpoint", client.Host, "error", err)
+		}
+	}
+	return nil, "", 0, lastErr
+}
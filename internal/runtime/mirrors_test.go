@@ -0,0 +1,47 @@
+package runtime
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/harsha3330/crun/internal/config"
+)
+
+func TestRegistryClientsOrder(t *testing.T) {
+	mirror := func(endpoints ...string) config.RegistryConfig {
+		var rc config.RegistryConfig
+		for _, e := range endpoints {
+			rc.Mirrors = append(rc.Mirrors, config.Mirror{Endpoint: e})
+		}
+		return rc
+	}
+	cfg := config.Config{RootDir: t.TempDir(), Registries: map[string]config.RegistryConfig{
+		"registry-1.docker.io": mirror("c.example.com"),
+		"index.docker.io":      mirror("b1.example.com", "b2.example.com"),
+		"docker.io":            mirror("https://a.example.com/"),
+		"ghcr.io":              mirror("ghcr-mirror.example.com"),
+	}}
+	want := []string{"a.example.com", "b1.example.com", "b2.example.com", "c.example.com", "registry-1.docker.io"}
+	// map order differs between runs, so a few tries would catch it
+	for range 20 {
+		clients, err := registryClients(cfg, "docker.io")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hosts []string
+		for _, c := range clients {
+			hosts = append(hosts, c.Host)
+		}
+		if !slices.Equal(hosts, want) {
+			t.Fatalf("endpoints %q, want %q", hosts, want)
+		}
+	}
+
+	clients, err := registryClients(cfg, "quay.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 1 || clients[0].Host != "quay.io" {
+		t.Errorf("a registry without mirrors got %d endpoints", len(clients))
+	}
+}
@@ -0,0 +1,261 @@
+package runtime
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/harsha3330/crun/internal/config"
+	logger "github.com/harsha3330/crun/internal/log"
+	"github.com/harsha3330/crun/internal/pkg"
+	"github.com/harsha3330/crun/internal/reference"
+)
+
+type PruneOptions struct {
+	// DryRun reports what would be removed without removing it.
+	DryRun bool
+
+	// Containers also removes the directories of containers that are no
+	// longer running, as crun system prune does. Otherwise every container
+	// directory keeps its image alive.
+	Containers bool
+}
+
+// PrunedItem is one thing Prune removed, or would remove.
+type PrunedItem struct {
+	Kind string
+	Name string
+	Size int64
+}
+
+// PruneReport lists what Prune removed and how many bytes that freed.
+type PruneReport struct {
+	Items     []PrunedItem
+	Reclaimed int64
+}
+
+// Prune garbage-collects the store. It marks the manifests that tags,
+// digest pins and containers use, and the blobs and layers those list,
+// then sweeps everything else: dangling manifests, unreferenced blobs and
+// layers, partial downloads, unfinished layer extractions and leftover
+// temporary files. It holds the store lock exclusively, so nothing is in
+// the middle of a pull, push or run while it looks.
+func Prune(cfg config.Config, log *slog.Logger, stater logger.Console, opts *PruneOptions) (*PruneReport, error) {
+	if opts == nil {
+		opts = &PruneOptions{}
+	}
+	locks, storeLock, err := lockStore(cfg, stater, true)
+	if err != nil {
+		return nil, err
+	}
+	defer storeLock.Unlock()
+
+	report := &PruneReport{}
+	sweep := func(kind, name, path string, size int64, remove func(string) error) {
+		if !opts.DryRun {
+			if err := remove(path); err != nil {
+				log.Warn("failed to remove "+kind, "name", name, "error", err)
+				stater.Warn("failed to remove "+kind, "name", name, "error", err)
+				return
+			}
+			log.Info("removed "+kind, "name", name, "bytes", size)
+		}
+		report.Items = append(report.Items, PrunedItem{Kind: kind, Name: name, Size: size})
+		report.Reclaimed += size
+	}
+
+	marks := newStoreMarks()
+	marks.markRefs(cfg.RootDir)
+	containersDir := filepath.Join(cfg.RootDir, "containers")
+	entries, _ := os.ReadDir(containersDir)
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join(containersDir, e.Name())
+		if opts.Containers && !containerRunning(dir) {
+			if opts.DryRun || unmountContainer(dir) == nil {
+				sweep("container", e.Name(), dir, containerSize(dir), os.RemoveAll)
+				continue
+			}
+			// its layers may still be mounted, so they stay
+			stater.Warn("cannot unmount the stopped container, keeping it", "container-id", e.Name())
+		}
+		markContainer(cfg.RootDir, dir, marks)
+	}
+
+	for _, name := range listRepositories(cfg.RootDir) {
+		dir := repoDir(cfg.RootDir, name)
+		manifests, _ := os.ReadDir(filepath.Join(dir, manifestsDir))
+		for _, m := range manifests {
+			digest := "sha256:" + m.Name()
+			if !m.IsDir() || marks.manifests[name+"@"+digest] {
+				continue
+			}
+			path := filepath.Join(dir, manifestsDir, m.Name())
+			sweep("manifest", name+"@"+digest, path, dirSize(path), os.RemoveAll)
+		}
+		// interrupted writes of tag, digest and manifest files
+		_ = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !strings.HasSuffix(d.Name(), ".tmp") {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			rel, _ := filepath.Rel(cfg.RootDir, path)
+			sweep("temporary file", rel, path, info.Size(), os.Remove)
+			return nil
+		})
+		if !opts.DryRun {
+			cleanEmptyParents(cfg.RootDir, name)
+		}
+	}
+
+	blobDir := filepath.Join(cfg.RootDir, "blobs")
+	blobs, _ := os.ReadDir(blobDir)
+	for _, b := range blobs {
+		if marks.digests[b.Name()] {
+			continue
+		}
+		kind := "blob"
+		switch {
+		case strings.HasSuffix(b.Name(), ".partial"):
+			kind = "partial download"
+		case strings.HasSuffix(b.Name(), ".tmp"):
+			kind = "temporary file"
+		}
+		path := filepath.Join(blobDir, b.Name())
+		size := dirSize(path)
+		if info, err := b.Info(); err == nil && !b.IsDir() {
+			size = info.Size()
+		}
+		sweep(kind, b.Name(), path, size, os.RemoveAll)
+	}
+
+	layerDir := filepath.Join(cfg.RootDir, "layers")
+	layers, _ := os.ReadDir(layerDir)
+	for _, l := range layers {
+		if marks.digests[l.Name()] {
+			continue
+		}
+		kind := "layer"
+		if strings.HasPrefix(l.Name(), ".") {
+			kind = "unfinished layer"
+		}
+		path := filepath.Join(layerDir, l.Name())
+		sweep(kind, l.Name(), path, dirSize(path), pkg.RemoveLayer)
+	}
+
+	if !opts.DryRun {
+		// nobody else can hold them while the store lock is held
+		locks.RemoveUnused()
+	}
+	return report, nil
+}
+
+// containerRunning reports whether the container in dir has a live process.
+func containerRunning(dir string) bool {
+	data, err := os.ReadFile(filepath.Join(dir, "pid"))
+	if err != nil {
+		return false
+	}
+	var pid int
+	if _, err := fmt.Sscanf(string(data), "%d", &pid); err != nil || pid <= 0 {
+		return false
+	}
+	err = syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// unmountContainer unmounts the container's overlay, if it is mounted.
+func unmountContainer(dir string) error {
+	err := syscall.Unmount(filepath.Join(dir, "merged"), 0)
+	if err == syscall.EINVAL || err == syscall.ENOENT {
+		return nil
+	}
+	return err
+}
+
+// containerSize is the space a container's own files take, leaving out the
+// image mounted under merged/.
+func containerSize(dir string) int64 {
+	var n int64
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if e.Name() != "merged" {
+			n += dirSize(filepath.Join(dir, e.Name()))
+		}
+	}
+	return n
+}
+
+// markContainer marks what the container in dir runs on: the manifest it
+// recorded, the layers its overlay has mounted and, for containers that
+// predate recording the manifest, whatever its image reference points at.
+func markContainer(rootDir, dir string, marks *storeMarks) {
+	if data, err := os.ReadFile(filepath.Join(dir, "manifest")); err == nil {
+		if name, digest, ok := strings.Cut(strings.TrimSpace(string(data)), "@"); ok {
+			marks.markManifest(rootDir, name, digest)
+		}
+	}
+	for _, path := range mountedLowerDirs(filepath.Join(dir, "merged")) {
+		if filepath.Dir(path) == filepath.Join(rootDir, "layers") {
+			marks.digests[filepath.Base(path)] = true
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "image")); err == nil {
+		if ref, err := reference.Parse(strings.TrimSpace(string(data))); err == nil {
+			refs, _ := readRefFile(refPath(rootDir, ref))
+			for _, r := range refs {
+				marks.markManifest(rootDir, ref.Name(), r.Manifest)
+			}
+		}
+	}
+}
+
+// mountedLowerDirs returns the lowerdirs of the overlay mounted at target,
+// read from /proc/self/mountinfo.
+func mountedLowerDirs(target string) []string {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// id parent major:minor root mountpoint options... - fstype source superoptions
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || unescapeMountPath(fields[4]) != target {
+			continue
+		}
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+3 >= len(fields) || fields[sep+1] != "overlay" {
+			continue
+		}
+		for _, opt := range strings.Split(fields[sep+3], ",") {
+			if lower, ok := strings.CutPrefix(opt, "lowerdir="); ok {
+				return strings.Split(unescapeMountPath(lower), ":")
+			}
+		}
+	}
+	return nil
+}
+
+// unescapeMountPath undoes the octal escapes mountinfo uses for spaces,
+// tabs, newlines and backslashes.
+func unescapeMountPath(s string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
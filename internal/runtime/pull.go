@@ -10,166 +10,342 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/harsha3330/crun/internal/config"
 	logger "github.com/harsha3330/crun/internal/log"
 	"github.com/harsha3330/crun/internal/pkg"
+	"github.com/harsha3330/crun/internal/registry"
 )
 
-const REGISTRY = "https://registry-1.docker.io"
+// DownloadBlob fetches a blob into destDir/<hex> and returns how many bytes
+// were resumed from an earlier attempt. The body is hashed as it streams
+// into <hex>.partial, which is renamed into place only once its size and
+// digest match the descriptor, so a blob in the store is always complete.
+//
+// A .partial left by an interrupted pull is kept and continued with a Range
+// request. Registries that answer 200, 416 or a range starting elsewhere
+// instead get a full download.
+// progress, if set, is called with the number of bytes of the blob on disk.
+func DownloadBlob(client *registry.Client, repo string, desc pkg.Descriptor, destDir string, progress func(int64)) (int64, error) {
+	return downloadBlob(client, repo, desc, destDir, progress, nil)
+}
 
-func parseImage(image string) (string, string, error) {
-	if image == "" {
-		return "", "", fmt.Errorf("image argument is empty")
-	}
-	parts := strings.Split(image, ":")
-	if len(parts) > 2 {
-		return "", "", fmt.Errorf("unrecognized format image: %s ", image)
-	}
-	if len(parts) == 1 {
-		return "", "", fmt.Errorf("empty tag recieved")
-	}
-	if parts[0] == "" || parts[1] == "" {
-		return "", "", fmt.Errorf("empty image repo or image recieved")
+// downloadBlob is DownloadBlob that also writes the blob to tee as it
+// arrives. tee has to see the blob from its first byte, so with a tee a
+// .partial is not resumed but downloaded again.
+func downloadBlob(client *registry.Client, repo string, desc pkg.Descriptor, destDir string, progress func(int64), tee io.Writer) (int64, error) {
+	verifier, err := pkg.NewDigestVerifier(desc.Digest)
+	if err != nil {
+		return 0, err
+	}
+	filename := filepath.Join(destDir, desc.Digest[7:])
+	if info, err := os.Stat(filename); err == nil {
+		// files that predate verification may be truncated, which the size
+		// gives away without rehashing the whole blob
+		if desc.Size <= 0 || info.Size() == desc.Size {
+			return 0, nil // already have this blob, skip download
+		}
+		if err := os.Remove(filename); err != nil {
+			return 0, err
+		}
 	}
-	if parts[1] == "latest" {
-		return "", "", fmt.Errorf("latest tag is not supported yet")
+
+	partial := filename + ".partial"
+	out, err := os.OpenFile(partial, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
 	}
-	return parts[0], parts[1], nil
-}
+	defer out.Close()
 
-func normalizeRepo(repo string) string {
-	if !strings.Contains(repo, "/") {
-		return "library/" + repo
+	var offset int64
+	if tee == nil {
+		// the bytes already on disk have to go through the verifier too, so
+		// the final digest covers the whole blob
+		if offset, err = io.Copy(verifier, out); err != nil {
+			return 0, err
+		}
+		if desc.Size > 0 && offset >= desc.Size {
+			if offset == desc.Size && verifier.Verify() == nil {
+				return 0, commitBlob(out, partial, filename)
+			}
+			offset = 0
+		}
 	}
-	return repo
-}
 
-func getToken(repo string) (string, error) {
-	repo = normalizeRepo(repo)
-	url := fmt.Sprintf("https://auth.docker.io/token?service=registry.docker.io&scope=repository:%s:pull", repo)
-	resp, err := http.Get(url)
+	resp, err := client.GetBlob(repo, desc.Digest, offset)
+	if err == nil && offset > 0 && resp.StatusCode == http.StatusPartialContent && !rangeStartsAt(resp, offset) {
+		// a range other than the one asked for cannot be appended
+		resp.Body.Close()
+		err = registry.ErrRangeNotSatisfiable
+	}
+	if err == registry.ErrRangeNotSatisfiable {
+		offset = 0
+		resp, err = client.GetBlob(repo, desc.Digest, 0)
+	}
 	if err != nil {
-		return "", err
+		return 0, err
 	}
 	defer resp.Body.Close()
-	var data struct {
-		Token string `json:"token"`
+	if resp.StatusCode != http.StatusPartialContent {
+		offset = 0
+	}
+	if offset == 0 {
+		verifier, _ = pkg.NewDigestVerifier(desc.Digest)
+		if err := out.Truncate(0); err != nil {
+			return 0, err
+		}
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		return "", err
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
 	}
-	return data.Token, nil
-}
 
-func getImageIndex(repo, tag, token string) ([]byte, error) {
-	url := fmt.Sprintf("%s/v2/library/%s/manifests/%s", REGISTRY, repo, tag)
-	req, _ := http.NewRequest("GET", url, nil)
-	bearerToken := "Bearer " + token
-	req.Header.Add("Authorization", bearerToken)
-	req.Header.Set("Accept",
-		"application/vnd.oci.image.index.v1+json, "+
-			"application/vnd.docker.distribution.manifest.list.v2+json, "+
-			"application/vnd.oci.image.manifest.v1+json, "+
-			"application/vnd.docker.distribution.manifest.v2+json",
-	)
-	resp, err := http.DefaultClient.Do(req)
+	body := pkg.NewProgressReader(resp.Body, offset, progress)
+	if progress != nil {
+		progress(offset)
+	}
+	if desc.Size > 0 {
+		// read one byte past the expected size so an oversized body is caught
+		body = io.LimitReader(body, desc.Size-offset+1)
+	}
+	w := io.MultiWriter(out, verifier)
+	if tee != nil {
+		w = io.MultiWriter(out, verifier, tee)
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		// keep what was written so the next pull can resume from it
+		return offset, fmt.Errorf("downloading blob %s: %w", desc.Digest, err)
+	}
+	if desc.Size > 0 && verifier.Size() != desc.Size {
+		err = fmt.Errorf("size mismatch: expected %d bytes, got %d", desc.Size, verifier.Size())
+	} else {
+		err = verifier.Verify()
+	}
 	if err != nil {
-		return nil, err
+		out.Close()
+		_ = os.Remove(partial)
+		return offset, fmt.Errorf("blob %s failed verification, partial download removed: %w", desc.Digest, err)
 	}
-	defer resp.Body.Close()
+	return offset, commitBlob(out, partial, filename)
+}
 
-	return io.ReadAll(resp.Body)
+// rangeStartsAt reports whether a 206 response body starts at offset.
+func rangeStartsAt(resp *http.Response, offset int64) bool {
+	var start int64
+	_, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start)
+	return err == nil && start == offset
 }
 
-func getImageManifest(repo, digest, token string) ([]byte, error) {
-	url := fmt.Sprintf("%s/v2/library/%s/blobs/%s", REGISTRY, repo, digest)
-	req, _ := http.NewRequest("GET", url, nil)
-	bearerToken := "Bearer " + token
-	req.Header.Add("Authorization", bearerToken)
-	resp, err := http.DefaultClient.Do(req)
+// configPlatform reads the platform an image was built for from its
+// downloaded config blob.
+func configPlatform(blobDir string, desc pkg.Descriptor) (pkg.Platform, error) {
+	data, err := os.ReadFile(filepath.Join(blobDir, strings.TrimPrefix(desc.Digest, "sha256:")))
 	if err != nil {
-		return nil, err
+		return pkg.Platform{}, err
 	}
-	defer resp.Body.Close()
-
-	return io.ReadAll(resp.Body)
+	var imageConfig pkg.OCIImageConfig
+	if err := json.Unmarshal(data, &imageConfig); err != nil {
+		return pkg.Platform{}, fmt.Errorf("decode image config: %w", err)
+	}
+	return pkg.NormalizePlatform(pkg.Platform{OS: imageConfig.OS, Arch: imageConfig.Architecture, Variant: imageConfig.Variant}), nil
 }
 
-func DownloadBlob(repo, digest, token, destDir string) error {
-	filename := filepath.Join(destDir, digest[7:])
-	if _, err := os.Stat(filename); err == nil {
-		return nil // already have this blob, skip download
-	}
-	url := fmt.Sprintf("https://registry-1.docker.io/v2/%s/blobs/%s", repo, digest)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Authorization", "Bearer "+token)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
+func commitBlob(out *os.File, partial, filename string) error {
+	if err := out.Close(); err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download %s: %s", digest, resp.Status)
+	return os.Rename(partial, filename)
+}
+
+// DownloadImageBlobs fetches blobs into destDir in parallel. Each blob is
+// tried on clients in order, moving to the next endpoint once one has used
+// up its retries. Each download holds the blob's lock from locks, so other
+// processes pulling the same blob wait for it and then find it in place.
+func DownloadImageBlobs(clients []*registry.Client, repo string, blobs []pkg.Descriptor, destDir string, locks *pkg.Locker, log *slog.Logger, stater logger.Console, progress *logger.Progress) error {
+	return fetchBlobs(clients, blobs, log, stater, progress, func(client *registry.Client, desc pkg.Descriptor, report func(int64)) (int64, error) {
+		lock, err := locks.Exclusive(pkg.BlobLock(strings.TrimPrefix(desc.Digest, "sha256:")))
+		if err != nil {
+			return 0, err
+		}
+		defer lock.Unlock()
+		return DownloadBlob(client, repo, desc, destDir, report)
+	})
+}
+
+// streamImageLayers downloads layers into blobDir and unpacks each into
+// layerDir while it downloads, with the same parallelism, retries,
+// endpoint fallback and locking as DownloadImageBlobs.
+func streamImageLayers(clients []*registry.Client, repo string, layers []pkg.Descriptor, blobDir, layerDir string, locks *pkg.Locker, log *slog.Logger, stater logger.Console, progress *logger.Progress) error {
+	return fetchBlobs(clients, layers, log, stater, progress, func(client *registry.Client, desc pkg.Descriptor, report func(int64)) (int64, error) {
+		digest := strings.TrimPrefix(desc.Digest, "sha256:")
+		// always blob before layer, as everywhere else
+		blobLock, err := locks.Exclusive(pkg.BlobLock(digest))
+		if err != nil {
+			return 0, err
+		}
+		defer blobLock.Unlock()
+		layerLock, err := locks.Exclusive(pkg.LayerLock(digest))
+		if err != nil {
+			return 0, err
+		}
+		defer layerLock.Unlock()
+		reject := func(name string, reason error) {
+			log.Warn("rejected layer entry", "digest", digest, "entry", name, "reason", reason)
+			stater.Warn("rejected layer entry", "digest", digest, "entry", name, "reason", reason)
+		}
+		return streamLayer(client, repo, desc, blobDir, layerDir, report, reject)
+	})
+}
+
+// streamLayer downloads a layer blob and unpacks it into layerDir/<hex> as
+// the bytes arrive instead of once the blob is complete. The layer is only
+// installed once the blob passes verification. A layer whose blob is
+// already in the store is unpacked from there, and a layer that is already
+// unpacked only has its blob downloaded.
+func streamLayer(client *registry.Client, repo string, desc pkg.Descriptor, blobDir, layerDir string, progress func(int64), reject func(string, error)) (int64, error) {
+	digest := strings.TrimPrefix(desc.Digest, "sha256:")
+	opts := &pkg.ExtractOptions{MediaType: desc.MediaType, OnReject: reject}
+	if _, err := os.Stat(filepath.Join(layerDir, digest)); err == nil {
+		return DownloadBlob(client, repo, desc, blobDir, progress)
+	}
+	if info, err := os.Stat(filepath.Join(blobDir, digest)); err == nil && (desc.Size <= 0 || info.Size() == desc.Size) {
+		_, err := pkg.EnsureLayerExtracted(blobDir, layerDir, digest, opts)
+		return 0, err
 	}
-	out, err := os.Create(filename)
-	if err != nil {
+
+	_, err := pkg.InstallLayer(layerDir, digest, func(dir string) error {
+		pr, pw := io.Pipe()
+		extracted := make(chan error, 1)
+		go func() {
+			err := pkg.ExtractLayer(pr, dir, opts)
+			if err == nil {
+				// the download cannot finish until the rest of the blob is read
+				_, err = io.Copy(io.Discard, pr)
+			}
+			if err != nil {
+				// fails the download with the same error
+				pr.CloseWithError(err)
+			}
+			extracted <- err
+		}()
+		_, err := downloadBlob(client, repo, desc, blobDir, progress, pw)
+		pw.CloseWithError(err)
+		if xerr := <-extracted; err == nil {
+			err = xerr
+		}
 		return err
-	}
-	defer out.Close()
-	_, err = io.Copy(out, resp.Body)
-	return err
+	})
+	return 0, err
 }
 
-func DownloadImageBlobs(repo string, config pkg.Descriptor, layers []pkg.Descriptor, destDir string, log *slog.Logger, stater logger.Console) error {
+// fetchBlobs runs fetch for every blob in parallel, retrying it on each
+// client in turn. fetch returns how many bytes it resumed.
+func fetchBlobs(clients []*registry.Client, blobs []pkg.Descriptor, log *slog.Logger, stater logger.Console, progress *logger.Progress, fetch func(client *registry.Client, desc pkg.Descriptor, report func(int64)) (int64, error)) error {
 	var wg sync.WaitGroup
+	var resumed atomic.Int64
 	sem := make(chan struct{}, 4)
-	token, err := getToken(repo)
-	if err != nil {
-		return fmt.Errorf("failed to get token: %w", err)
-	}
-	errCh := make(chan error, len(layers))
-	download := func(digest string) {
+	errCh := make(chan error, len(blobs))
+	download := func(desc pkg.Descriptor) {
 		defer wg.Done()
 		sem <- struct{}{}
 		defer func() { <-sem }()
-		if err := DownloadBlob(repo, digest, token, destDir); err != nil {
-			log.Error("error downloading %s: %v", digest, err)
+		digest := desc.Digest
+		// seen is how much of the blob this pull has already had on disk,
+		// so bytes a retry resumes from an earlier attempt are not counted
+		// as resumed again
+		var seen int64
+		report := func(n int64) {
+			seen = max(seen, n)
+			progress.Update(logger.ProgressEvent{ID: digest, Action: "downloading", Current: n, Total: desc.Size})
+		}
+		defer progress.Update(logger.ProgressEvent{ID: digest, Action: "downloading", Done: true})
+		var err error
+		var client *registry.Client
+		for i := range clients {
+			client = clients[i]
+			if i > 0 {
+				log.Warn("blob download failed, trying next endpoint", "digest", digest, "failed", clients[i-1].Host, "next", client.Host, "error", err)
+				stater.Warn("blob download failed, trying next endpoint", "digest", digest, "endpoint", client.Host, "error", err)
+			}
+			for attempt := 0; attempt < registry.MaxAttempts; attempt++ {
+				if attempt > 0 {
+					// the .partial kept by the failed attempt is resumed
+					wait := registry.Backoff(attempt - 1)
+					log.Warn("retrying blob download", "digest", digest, "endpoint", client.Host, "attempt", attempt+1, "wait", wait, "error", err)
+					stater.Warn("retrying blob download", "digest", digest, "wait", wait.Round(time.Millisecond), "error", err)
+					time.Sleep(wait)
+				}
+				before := seen
+				var n int64
+				n, err = fetch(client, desc, report)
+				if n > before {
+					resumed.Add(n - before)
+					log.Info("resumed blob download", "digest", digest, "bytes", n-before)
+					stater.Step("resumed blob download", "digest", digest, "bytes", n-before)
+				}
+				if !registry.Retryable(err) {
+					break
+				}
+			}
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			log.Error("error downloading blob", "digest", digest, "error", err)
 			stater.Error("error downloading blob", "digest", digest, "error", err.Error())
 			errCh <- err
 			return
 		}
 		// DownloadBlob returns nil if blob already existed (skipped) or was downloaded
-		log.Info("blob ready", "digest", digest)
-		stater.Success("blob ready", "digest", digest)
+		log.Info("blob ready", "digest", digest, "endpoint", client.Host)
+		stater.Success("blob ready", "digest", digest, "endpoint", client.Host)
 	}
-	wg.Add(1)
-	go download(config.Digest)
-	for _, layer := range layers {
+	for _, blob := range blobs {
 		wg.Add(1)
-		go download(layer.Digest)
+		go download(blob)
 	}
 	wg.Wait()
 	close(errCh)
+	if n := resumed.Load(); n > 0 {
+		stater.Success("resumed interrupted downloads", "bytes", n)
+	}
 	for err := range errCh {
 		return err
 	}
 	return nil
 }
 
-func extractImage(blobDir, layerDir string, layers []pkg.Descriptor, log *slog.Logger, stater logger.Console) error {
+func extractImage(blobDir, layerDir string, layers []pkg.Descriptor, locks *pkg.Locker, log *slog.Logger, stater logger.Console, progress *logger.Progress) error {
 	var wg sync.WaitGroup
 	sem := make(chan struct{}, 4)
 	errCh := make(chan error, len(layers))
-	extract := func(blobDir, layerDir, digest string) {
+	extract := func(blobDir, layerDir string, layer pkg.Descriptor) {
 		defer wg.Done()
 		sem <- struct{}{}
 		defer func() { <-sem }()
 
-		fspath, err := pkg.EnsureLayerExtracted(blobDir, layerDir, digest)
+		digest := strings.TrimPrefix(layer.Digest, "sha256:")
+		report := func(n int64) {
+			progress.Update(logger.ProgressEvent{ID: layer.Digest, Action: "extracting", Current: n, Total: layer.Size})
+		}
+		defer progress.Update(logger.ProgressEvent{ID: layer.Digest, Action: "extracting", Done: true})
+		reject := func(name string, reason error) {
+			log.Warn("rejected layer entry", "digest", digest, "entry", name, "reason", reason)
+			stater.Warn("rejected layer entry", "digest", digest, "entry", name, "reason", reason)
+		}
+		lock, err := locks.Exclusive(pkg.LayerLock(digest))
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer lock.Unlock()
+		fspath, err := pkg.EnsureLayerExtracted(blobDir, layerDir, digest, &pkg.ExtractOptions{
+			MediaType: layer.MediaType,
+			Progress:  report,
+			OnReject:  reject,
+		})
 		if err != nil {
 			log.Error("error extracting image layer", "digest", digest)
 			stater.Error("error extracting image layer", "digest", digest)
@@ -182,9 +358,8 @@ func extractImage(blobDir, layerDir string, layers []pkg.Descriptor, log *slog.L
 	}
 
 	for _, layer := range layers {
-		digest := strings.TrimPrefix(layer.Digest, "sha256:")
 		wg.Add(1)
-		go extract(blobDir, layerDir, digest)
+		go extract(blobDir, layerDir, layer)
 	}
 	wg.Wait()
 	close(errCh)
@@ -194,86 +369,192 @@ func extractImage(blobDir, layerDir string, layers []pkg.Descriptor, log *slog.L
 	return nil
 }
 
-func Pull(cfg config.Config, log *slog.Logger, stater logger.Console, image string) error {
+type PullOptions struct {
+	// Platform is the "os/arch[/variant]" to pull; empty means this host.
+	Platform string
+
+	// Stream unpacks each layer while it downloads rather than after all
+	// of them are in. An interrupted layer is then downloaded again from
+	// the start instead of being resumed.
+	Stream bool
+}
+
+func Pull(cfg config.Config, log *slog.Logger, stater logger.Console, image string, opts *PullOptions) error {
+	if opts == nil {
+		opts = &PullOptions{}
+	}
 	log.Info("Starting pull the image", "value", image)
 	stater.Step("Pulling the image", "value", image)
-	repo, tag, err := parseImage(image)
-	log.Debug("recived the following image contents", "image repo", repo, "image tag", tag)
-	stater.Step("Image Arguments", "repository", repo, "tag", tag)
+	ref, err := parseImage(image)
 	if err != nil {
 		log.Error(err.Error())
 		stater.Error(err.Error())
 		return err
 	}
-	stater.Step("Getting auth to pull image manifests")
-	token, err := getToken(repo)
+	platform := pkg.HostPlatform()
+	if opts.Platform != "" {
+		if platform, err = pkg.ParsePlatform(opts.Platform); err != nil {
+			stater.Error(err.Error())
+			return err
+		}
+	}
+	// a digest pins the content, so it wins over any tag given alongside it
+	target := ref.Tag
+	if ref.Digest != "" {
+		target = ref.Digest
+	}
+	log.Debug("recived the following image contents", "image repo", ref.Name(), "image tag", ref.Tag, "image digest", ref.Digest)
+	stater.Step("Image Arguments", "repository", ref.Name(), "reference", target)
+	clients, err := registryClients(cfg, ref.Domain)
 	if err != nil {
-		stater.Error("Failed to get the bearer token of the repository", "repository", repo)
+		stater.Error("error configuring registry endpoints", "registry", ref.Domain, "error", err)
 		return err
 	}
-	stater.Success("Got the bearer token of the repository", "repository", repo)
-	stater.Step("Getting the image index")
-	imageIndexData, err := getImageIndex(repo, tag, token)
+	for _, client := range clients {
+		log.Debug("resolved registry endpoint", "host", client.Host, "scheme", client.Scheme, "repository", ref.Path)
+	}
+	stater.Step("Getting the image index", "registry", ref.Domain)
+	imageIndexData, contentType, served, err := fetchManifest(clients, ref.Path, target, ref.Digest, log, stater)
 	if err != nil {
-		stater.Error("error getting the image index data", "repo", repo, "tag", tag)
+		stater.Error("error getting the image index data", "repo", ref.Name(), "reference", target, "error", err)
 		return err
 	}
-	stater.Success("got the image index data", "repo", repo, "tag", tag)
+	// endpoints before the one that answered have already failed
+	clients = clients[served:]
+	stater.Success("got the image index data", "repo", ref.Name(), "reference", target, "endpoint", clients[0].Host)
 	log.Debug("image manifest file", "content", imageIndexData)
-	stater.Step("Decoding image index data")
-	ociIndex, err := pkg.DecodeIndex(imageIndexData)
+	mediaType, err := pkg.ManifestMediaType(contentType, imageIndexData)
 	if err != nil {
-		stater.Error("error decoding the image index data")
+		stater.Error("unsupported image manifest", "reference", target, "error", err)
 		return err
 	}
-	stater.Success("Decoded the image index data")
-	log.Debug("Index Decoded content", "OCI Index", ociIndex)
-	platform := pkg.HostPlatform()
-	stater.Step("Got the platform details", "OS", platform.OS, "Architecture", platform.Arch)
-	imageDigest, err := pkg.SelectPlatformManifest(ociIndex, platform.OS, platform.Arch)
+	log.Debug("image manifest media type", "mediaType", mediaType, "contentType", contentType)
+
+	var imageDigest string
+	var ociManifestData []byte
+	// resolved stays empty for a single manifest, whose platform is only
+	// known from its config
+	var resolved pkg.Platform
+	if pkg.IsManifestMediaType(mediaType) {
+		// single-platform image, or pinned to a platform manifest
+		stater.Step("registry returned a single image manifest", "mediaType", mediaType)
+		imageDigest, ociManifestData = ref.Digest, imageIndexData
+		if imageDigest == "" {
+			imageDigest = pkg.ComputeDigest(imageIndexData)
+		}
+	} else {
+		stater.Step("Decoding image index data")
+		ociIndex, err := pkg.DecodeIndex(imageIndexData)
+		if err != nil {
+			stater.Error("error decoding the image index data")
+			return err
+		}
+		stater.Success("Decoded the image index data")
+		log.Debug("Index Decoded content", "OCI Index", ociIndex)
+		stater.Step("Got the platform details", "platform", platform)
+		imageDigest, resolved, err = pkg.SelectPlatformManifest(ociIndex, platform)
+		if err != nil {
+			stater.Error("error getting the manifest for this platform", "platform", platform, "error", err)
+			return err
+		}
+		stater.Step("selected platform manifest", "platform", resolved, "digest", imageDigest)
+		log.Debug("Platform Manifest Digest", "Manifest", imageDigest, "platform", resolved)
+		stater.Step("Getting Image Layers , Configs")
+		ociManifestData, contentType, served, err = fetchManifest(clients, ref.Path, imageDigest, imageDigest, log, stater)
+		if err != nil {
+			stater.Error("Error getting image manifests (contains config , layers)", "error", err)
+			return err
+		}
+		clients = clients[served:]
+		if mediaType, err = pkg.ManifestMediaType(contentType, ociManifestData); err == nil && !pkg.IsManifestMediaType(mediaType) {
+			err = fmt.Errorf("manifest %s: expected an image manifest, got %s", imageDigest, mediaType)
+		}
+		if err != nil {
+			stater.Error("index entry is not an image manifest", "digest", imageDigest, "error", err)
+			return err
+		}
+	}
+	log.Debug("Image Manifest", "Data", ociManifestData)
+	imageManifest, err := pkg.DecodeManifestAuto(ociManifestData)
 	if err != nil {
-		stater.Error("error getting the manifest for this platform", "os", platform.OS, "architecture", platform.Arch)
+		stater.Error("Error decoding image manifests (contains config , layers)")
 		return err
 	}
-	log.Debug("Platform Manifest Digest", "Manifest", imageDigest, "OS", platform.OS, "Architecture", platform.Arch)
-	stater.Step("Getting Image Layers , Configs")
-	ociManifestData, err := getImageManifest(repo, imageDigest, token)
+	log.Debug("Decoded Image Manifest", "value", imageManifest)
+	stater.Success("Got the image manifest data , layers , config")
+	config, layers := imageManifest.Config, imageManifest.Layers
+	blobDir := filepath.Join(cfg.RootDir, "blobs")
+
+	// other pulls may share blobs and layers with this one, and rmi must
+	// not delete them until the image is recorded
+	locks, storeLock, err := lockStore(cfg, stater, false)
 	if err != nil {
-		stater.Error("Error getting image manifests (contains config , layers)")
 		return err
 	}
-	log.Debug("Image Manifest", "Data", ociManifestData)
-	imageManifest, err := pkg.DecodeManifestAuto(ociManifestData)
-	if err != nil {
-		stater.Error("Error decoding image manifests (contains config , layers)")
+	defer storeLock.Unlock()
+
+	// the config comes first: without an index it is the only record of
+	// which platform the image was built for
+	progress := logger.NewProgress(os.Stdout)
+	defer progress.Stop()
+	if err := DownloadImageBlobs(clients, ref.Path, []pkg.Descriptor{config}, blobDir, locks, log, stater, progress); err != nil {
+		stater.Error("Error Downloading image config")
 		return err
 	}
+	if resolved == (pkg.Platform{}) {
+		if resolved, err = configPlatform(blobDir, config); err != nil {
+			stater.Error("error reading the image config", "error", err)
+			return err
+		}
+		if _, ok := pkg.MatchPlatform(platform, resolved); !ok {
+			stater.Error("image does not match the requested platform", "image", resolved, "platform", platform)
+			return fmt.Errorf("%s is built for %s, not %s (use --platform %s to pull it anyway)", ref, resolved, platform, resolved)
+		}
+		stater.Step("image config platform", "platform", resolved)
+	}
 
-	err = pkg.SaveFile(filepath.Join(cfg.RootDir, "images", repo, "manifests", imageDigest[7:], "manifest.json"), ociManifestData)
+	err = pkg.SaveFile(manifestPath(cfg.RootDir, ref.Name(), imageDigest), ociManifestData)
 	if err != nil {
 		stater.Error("error saving the manifests file")
 		return err
 	}
 	stater.Success("saved the manifest file")
-	log.Debug("Decoded Image Manifest", "value", imageManifest)
-	stater.Success("Got the image manifest data , layers , config")
-	config, layers := imageManifest.Config, imageManifest.Layers
-	err = DownloadImageBlobs(normalizeRepo(repo), config, layers, filepath.Join(cfg.RootDir, "blobs"), log, stater)
+	layerDir := filepath.Join(cfg.RootDir, "layers")
+	// layers whose unpacking was killed are started over below
+	if n, err := pkg.CleanLayerTemps(layerDir); err != nil {
+		log.Warn("error removing unfinished layer extractions", "error", err)
+		stater.Warn("error removing unfinished layer extractions", "error", err)
+	} else if n > 0 {
+		log.Info("removed unfinished layer extractions", "count", n)
+		stater.Step("removed unfinished layer extractions", "count", n)
+	}
+	if opts.Stream {
+		err = streamImageLayers(clients, ref.Path, layers, blobDir, layerDir, locks, log, stater, progress)
+	} else {
+		err = DownloadImageBlobs(clients, ref.Path, layers, blobDir, locks, log, stater, progress)
+	}
 	if err != nil {
 		stater.Error("Error Downloading image blobs")
 		return err
 	}
-	tagFilePath := filepath.Join(cfg.RootDir, "images", repo, "tags", tag)
-	err = pkg.SaveFile(tagFilePath, []byte(imageDigest))
+	err = recordRef(cfg.RootDir, ref, resolved, imageDigest)
 	if err != nil {
 		stater.Error("error saving tag file data of the manifests")
+		return err
 	}
+	log.Info("recorded image platform", "image", ref.String(), "platform", resolved, "manifest", imageDigest)
 
-	blobDir, layerDir := filepath.Join(cfg.RootDir, "blobs"), filepath.Join(cfg.RootDir, "layers")
-	err = extractImage(blobDir, layerDir, layers, log, stater)
-	if err != nil {
-		stater.Error("error extracting layers into filesystem", "error", err.Error())
-		return err
+	if !opts.Stream {
+		err = extractImage(blobDir, layerDir, layers, locks, log, stater, progress)
+		if err != nil {
+			stater.Error("error extracting layers into filesystem", "error", err.Error())
+			return err
+		}
+	}
+	meta := ImageMetadata{PulledAt: time.Now().UTC(), Reference: ref.String(), Registry: ref.Domain, Endpoint: clients[0].Host}
+	if err := saveMetadata(cfg.RootDir, ref.Name(), imageDigest, meta); err != nil {
+		log.Warn("error saving the image metadata", "error", err)
+		stater.Warn("error saving the image metadata", "error", err)
 	}
 	stater.Success("extracted all the layers into filesystem , image pull completed")
 	return nil
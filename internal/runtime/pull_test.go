@@ -0,0 +1,302 @@
+package runtime
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	logger "github.com/harsha3330/crun/internal/log"
+	"github.com/harsha3330/crun/internal/pkg"
+	"github.com/harsha3330/crun/internal/registry"
+)
+
+// blobClient returns a client for a registry serving every blob with
+// handler.
+func blobClient(t *testing.T, handler http.HandlerFunc) *registry.Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return registry.NewClient(strings.TrimPrefix(srv.URL, "http://"), registry.Options{})
+}
+
+func blobDescriptor(data string) pkg.Descriptor {
+	return pkg.Descriptor{Digest: sha256Hex(data), Size: int64(len(data))}
+}
+
+func sha256Hex(data string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(data)))
+}
+
+func TestDownloadBlobVerifies(t *testing.T) {
+	const blob = "layer contents"
+	tests := []struct {
+		name string
+		body string
+		err  string
+	}{
+		{"wrong digest", "layer c0ntents", "digest mismatch"},
+		{"longer than the descriptor", blob + " and more", "size mismatch"},
+		{"shorter than the descriptor", blob[:5], "size mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			desc := blobDescriptor(blob)
+			client := blobClient(t, func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, tt.body)
+			})
+			_, err := DownloadBlob(client, "app", desc, dir, nil)
+			if err == nil || !strings.Contains(err.Error(), "failed verification") || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got %v, want a %s", err, tt.err)
+			}
+			entries, _ := os.ReadDir(dir)
+			for _, e := range entries {
+				t.Errorf("left %s behind", e.Name())
+			}
+		})
+	}
+
+	t.Run("good", func(t *testing.T) {
+		dir := t.TempDir()
+		desc := blobDescriptor(blob)
+		client := blobClient(t, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, blob)
+		})
+		if _, err := DownloadBlob(client, "app", desc, dir, nil); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, desc.Digest[7:]))
+		if err != nil || string(data) != blob {
+			t.Errorf("stored %q, %v", data, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, desc.Digest[7:]+".partial")); !os.IsNotExist(err) {
+			t.Errorf("partial download left: %v", err)
+		}
+	})
+}
+
+func TestDownloadBlobResumes(t *testing.T) {
+	const blob = "0123456789"
+	const kept = 4 // bytes of the blob left in .partial by an earlier pull
+	tests := []struct {
+		name string
+		// answer serves a request for the blob
+		answer  func(w http.ResponseWriter, r *http.Request)
+		resumed int64
+		// ranges are the Range headers the registry was sent
+		ranges []string
+	}{
+		{"partial content", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-9/10", kept))
+			w.WriteHeader(http.StatusPartialContent)
+			io.WriteString(w, blob[kept:])
+		}, kept, []string{"bytes=4-"}},
+		{"range ignored", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, blob)
+		}, 0, []string{"bytes=4-"}},
+		{"range at the wrong offset", func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Range") != "" {
+				w.Header().Set("Content-Range", "bytes 6-9/10")
+				w.WriteHeader(http.StatusPartialContent)
+				io.WriteString(w, blob[6:])
+				return
+			}
+			io.WriteString(w, blob)
+		}, 0, []string{"bytes=4-", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			desc := blobDescriptor(blob)
+			path := filepath.Join(dir, desc.Digest[7:])
+			writeStoreFile(t, path+".partial", blob[:kept])
+			var ranges []string
+			client := blobClient(t, func(w http.ResponseWriter, r *http.Request) {
+				ranges = append(ranges, r.Header.Get("Range"))
+				tt.answer(w, r)
+			})
+			var progress []int64
+			resumed, err := DownloadBlob(client, "app", desc, dir, func(n int64) { progress = append(progress, n) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resumed != tt.resumed {
+				t.Errorf("resumed %d bytes, want %d", resumed, tt.resumed)
+			}
+			if strings.Join(ranges, ",") != strings.Join(tt.ranges, ",") {
+				t.Errorf("ranges %q, want %q", ranges, tt.ranges)
+			}
+			if data, err := os.ReadFile(path); err != nil || string(data) != blob {
+				t.Errorf("stored %q, %v", data, err)
+			}
+			if len(progress) == 0 || progress[0] != tt.resumed || progress[len(progress)-1] != int64(len(blob)) {
+				t.Errorf("progress %v, want it to run from %d to %d", progress, tt.resumed, len(blob))
+			}
+		})
+	}
+}
+
+func TestFetchBlobsCountsResumedBytesOnce(t *testing.T) {
+	var buf strings.Builder
+	log := slog.New(slog.NewTextHandler(&buf, nil))
+	desc := blobDescriptor("0123456789")
+	clients := []*registry.Client{registry.NewClient("one.example.com", registry.Options{}), registry.NewClient("two.example.com", registry.Options{})}
+	attempt := 0
+	err := fetchBlobs(clients, []pkg.Descriptor{desc}, log, logger.Console{}, nil, func(client *registry.Client, desc pkg.Descriptor, report func(int64)) (int64, error) {
+		attempt++
+		switch attempt {
+		case 1:
+			// an earlier pull left 2 bytes; this attempt gets to 6 and fails
+			report(2)
+			report(6)
+			return 2, &registry.Error{StatusCode: http.StatusServiceUnavailable}
+		case 2:
+			// the retry resumes the 6 bytes, 4 of which this pull fetched
+			report(6)
+			report(8)
+			return 6, &registry.Error{StatusCode: http.StatusServiceUnavailable}
+		default:
+			report(8)
+			report(10)
+			return 8, nil
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if !strings.Contains(line, `msg="resumed blob download"`) {
+			continue
+		}
+		var n int64
+		_, after, _ := strings.Cut(line, "bytes=")
+		fmt.Sscanf(after, "%d", &n)
+		total += n
+	}
+	if total != 2 {
+		t.Errorf("reported %d resumed bytes, want the 2 from the earlier pull", total)
+	}
+}
+
+// layerTar returns a layer tarball holding the given files.
+func layerTar(t *testing.T, files map[string]string) string {
+	t.Helper()
+	var buf strings.Builder
+	tw := tar.NewWriter(&buf)
+	for name, body := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, body)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// checkNoStreamGoroutines fails t if a goroutine streamLayer started is
+// still running.
+func checkNoStreamGoroutines(t *testing.T) {
+	t.Helper()
+	var stacks string
+	for range 50 {
+		buf := make([]byte, 1<<20)
+		stacks = string(buf[:goruntime.Stack(buf, true)])
+		if !strings.Contains(stacks, "runtime.streamLayer") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("streamLayer goroutines left running:\n%s", stacks)
+}
+
+func TestStreamLayer(t *testing.T) {
+	layer := layerTar(t, map[string]string{"etc/hostname": "crun\n"})
+	desc := blobDescriptor(layer)
+	hex := desc.Digest[7:]
+	blobDir, layerDir := t.TempDir(), t.TempDir()
+	client := blobClient(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, layer)
+	})
+	if _, err := streamLayer(client, "app", desc, blobDir, layerDir, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(layerDir, hex, "etc/hostname")); err != nil || string(data) != "crun\n" {
+		t.Errorf("layer holds %q, %v", data, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(blobDir, hex)); err != nil || string(data) != layer {
+		t.Errorf("blob %v", err)
+	}
+	checkNoStreamGoroutines(t)
+}
+
+func TestStreamLayerExtractionFails(t *testing.T) {
+	blobDir, layerDir := t.TempDir(), t.TempDir()
+	// not a tar, and far longer than the first read
+	garbage := strings.Repeat("not a tar ", 1<<20)
+	desc := blobDescriptor(garbage)
+	aborted := make(chan bool, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(garbage)))
+		io.WriteString(w, garbage[:64<<10])
+		w.(http.Flusher).Flush()
+		// the rest is only sent if the client is still reading
+		select {
+		case <-r.Context().Done():
+			aborted <- true
+		case <-time.After(5 * time.Second):
+			aborted <- false
+			io.WriteString(w, garbage[64<<10:])
+		}
+	}))
+	defer srv.Close()
+	client := registry.NewClient(strings.TrimPrefix(srv.URL, "http://"), registry.Options{})
+
+	_, err := streamLayer(client, "app", desc, blobDir, layerDir, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "invalid tar header") {
+		t.Fatalf("got %v, want the extraction error", err)
+	}
+	if !<-aborted {
+		t.Error("the download went on after extraction failed")
+	}
+	entries, _ := os.ReadDir(layerDir)
+	for _, e := range entries {
+		t.Errorf("left %s in the layer directory", e.Name())
+	}
+	if _, err := os.Stat(filepath.Join(blobDir, desc.Digest[7:])); !os.IsNotExist(err) {
+		t.Errorf("blob committed: %v", err)
+	}
+	srv.Close()
+	checkNoStreamGoroutines(t)
+}
+
+func TestStreamLayerDownloadFails(t *testing.T) {
+	// the layer unpacks fine but is not the blob the manifest names
+	blobDir, layerDir := t.TempDir(), t.TempDir()
+	desc := blobDescriptor(layerTar(t, map[string]string{"etc/hostname": "crun\n"}))
+	client := blobClient(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, layerTar(t, map[string]string{"etc/hostname": "evil\n"}))
+	})
+	_, err := streamLayer(client, "app", desc, blobDir, layerDir, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "failed verification") {
+		t.Fatalf("got %v, want the verification error", err)
+	}
+	entries, _ := os.ReadDir(layerDir)
+	for _, e := range entries {
+		t.Errorf("left %s in the layer directory", e.Name())
+	}
+	checkNoStreamGoroutines(t)
+}
@@ -0,0 +1,322 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harsha3330/crun/internal/config"
+	logger "github.com/harsha3330/crun/internal/log"
+	"github.com/harsha3330/crun/internal/pkg"
+	"github.com/harsha3330/crun/internal/reference"
+	"github.com/harsha3330/crun/internal/registry"
+)
+
+type PushOptions struct {
+	// Platform pushes only the manifest pulled for this "os/arch[/variant]";
+	// empty pushes every platform the image was pulled for.
+	Platform string
+
+	// ChunkSize uploads blobs in chunks of this many bytes; zero uploads
+	// each blob in a single request.
+	ChunkSize int64
+}
+
+// pushIndex is the OCI index Push builds when an image was pulled for
+// several platforms.
+type pushIndex struct {
+	SchemaVersion int              `json:"schemaVersion"`
+	MediaType     string           `json:"mediaType"`
+	Manifests     []pushIndexEntry `json:"manifests"`
+}
+
+type pushIndexEntry struct {
+	MediaType string       `json:"mediaType"`
+	Digest    string       `json:"digest"`
+	Size      int64        `json:"size"`
+	Platform  pushPlatform `json:"platform"`
+}
+
+type pushPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Push uploads the locally pulled image to the registry named by dest,
+// which defaults to the image's own reference. Blobs come from
+// RootDir/blobs and manifests from the ones Pull saved, byte for byte, so
+// pushed manifests keep their digests. An image pulled for one platform is
+// pushed as that manifest; one pulled for several is pushed as an index of
+// them.
+func Push(cfg config.Config, log *slog.Logger, stater logger.Console, image, dest string, opts *PushOptions) error {
+	if opts == nil {
+		opts = &PushOptions{}
+	}
+	src, err := parseImage(image)
+	if err != nil {
+		stater.Error(err.Error())
+		return err
+	}
+	if dest == "" {
+		dest = image
+	}
+	dst, err := parseImage(dest)
+	if err != nil {
+		stater.Error(err.Error())
+		return err
+	}
+	if dst.Digest != "" {
+		err := fmt.Errorf("cannot push to %s: the destination must be a tag", dst)
+		stater.Error(err.Error())
+		return err
+	}
+	stater.Step("Pushing the image", "image", src.String(), "destination", dst.String())
+	_, storeLock, err := lockStore(cfg, stater, false)
+	if err != nil {
+		return err
+	}
+	defer storeLock.Unlock()
+
+	refs, err := localManifests(cfg.RootDir, src)
+	if err != nil {
+		stater.Error("image not available locally", "image", src.String(), "error", err)
+		return err
+	}
+	if opts.Platform != "" {
+		platform, err := pkg.ParsePlatform(opts.Platform)
+		if err != nil {
+			stater.Error(err.Error())
+			return err
+		}
+		candidates := make([]pkg.Platform, len(refs))
+		for i, r := range refs {
+			candidates[i] = r.Platform
+		}
+		best := pkg.BestPlatform(platform, candidates)
+		if best < 0 {
+			err := fmt.Errorf("image %s is not pulled for %s", src, platform)
+			stater.Error(err.Error())
+			return err
+		}
+		refs = refs[best : best+1]
+	}
+
+	creds, err := registry.LoadCredentials(cfg.RootDir, dst.Domain)
+	if err != nil {
+		stater.Error("failed to load registry credentials", "registry", dst.Domain, "error", err)
+		return err
+	}
+	client := registry.NewClient(dst.Domain, registry.Options{Credentials: creds})
+	// blobs of an image pulled from the same registry can be linked from
+	// their source repository instead of being sent again
+	var mountFrom string
+	if src.Domain == dst.Domain && src.Path != dst.Path {
+		mountFrom = src.Path
+	}
+
+	progress := logger.NewProgress(os.Stdout)
+	defer progress.Stop()
+	blobDir := filepath.Join(cfg.RootDir, "blobs")
+	pushed := make(map[string]bool)
+	index := pushIndex{SchemaVersion: 2, MediaType: pkg.MediaTypeOCIIndex}
+	var data []byte
+	var mediaType string
+	for _, r := range refs {
+		data, err = os.ReadFile(manifestPath(cfg.RootDir, src.Name(), r.Manifest))
+		if err != nil {
+			stater.Error("failed to read the image manifest", "manifest", r.Manifest, "error", err)
+			return err
+		}
+		if mediaType, err = pkg.ManifestMediaType("", data); err == nil && !pkg.IsManifestMediaType(mediaType) {
+			err = fmt.Errorf("manifest %s: expected an image manifest, got %s", r.Manifest, mediaType)
+		}
+		if err != nil {
+			stater.Error("unsupported image manifest", "manifest", r.Manifest, "error", err)
+			return err
+		}
+		manifest, err := pkg.DecodeManifestAuto(data)
+		if err != nil {
+			stater.Error("error decoding the image manifest", "manifest", r.Manifest, "error", err)
+			return err
+		}
+		var blobs []pkg.Descriptor
+		for _, desc := range append([]pkg.Descriptor{manifest.Config}, manifest.Layers...) {
+			if !pushed[desc.Digest] {
+				pushed[desc.Digest] = true
+				blobs = append(blobs, desc)
+			}
+		}
+		if err := UploadImageBlobs(client, dst.Path, blobs, blobDir, mountFrom, opts.ChunkSize, log, stater, progress); err != nil {
+			stater.Error("error uploading image blobs", "error", err)
+			return err
+		}
+		if len(refs) > 1 {
+			if _, err := client.PutManifest(dst.Path, r.Manifest, mediaType, data); err != nil {
+				stater.Error("error pushing the image manifest", "platform", r.Platform, "error", err)
+				return err
+			}
+			stater.Success("pushed the image manifest", "platform", r.Platform, "digest", r.Manifest)
+			index.Manifests = append(index.Manifests, pushIndexEntry{
+				MediaType: mediaType,
+				Digest:    r.Manifest,
+				Size:      int64(len(data)),
+				Platform:  pushPlatform{Architecture: r.Platform.Arch, OS: r.Platform.OS, Variant: r.Platform.Variant},
+			})
+		}
+	}
+	if len(refs) > 1 {
+		if data, err = json.Marshal(index); err != nil {
+			return err
+		}
+		mediaType = pkg.MediaTypeOCIIndex
+	}
+	digest, err := client.PutManifest(dst.Path, dst.Tag, mediaType, data)
+	if err != nil {
+		stater.Error("error pushing the image manifest", "reference", dst.String(), "error", err)
+		return err
+	}
+	if digest == "" {
+		digest = pkg.ComputeDigest(data)
+	}
+	log.Info("pushed image", "image", src.String(), "destination", dst.String(), "digest", digest, "platforms", len(refs))
+	stater.Success("image pushed", "destination", dst.String(), "digest", digest)
+	return nil
+}
+
+// localManifests returns the platform manifests ref was pulled as. A digest
+// that names a stored manifest directly stands for that manifest alone.
+func localManifests(rootDir string, ref reference.Reference) ([]platformRef, error) {
+	refs, err := readRefFile(refPath(rootDir, ref))
+	if err == nil && len(refs) > 0 {
+		return refs, nil
+	}
+	if ref.Digest != "" {
+		if _, serr := os.Stat(manifestPath(rootDir, ref.Name(), ref.Digest)); serr == nil {
+			platform, perr := manifestPlatform(rootDir, ref.Name(), ref.Digest)
+			if perr != nil {
+				return nil, perr
+			}
+			return []platformRef{{Platform: platform, Manifest: ref.Digest}}, nil
+		}
+	}
+	if err == nil || os.IsNotExist(err) {
+		return nil, fmt.Errorf("image not found: %s", ref)
+	}
+	return nil, err
+}
+
+// manifestPlatform reads the platform of a stored manifest from its config.
+func manifestPlatform(rootDir, name, digest string) (pkg.Platform, error) {
+	data, err := os.ReadFile(manifestPath(rootDir, name, digest))
+	if err != nil {
+		return pkg.Platform{}, err
+	}
+	manifest, err := pkg.DecodeManifestAuto(data)
+	if err != nil {
+		return pkg.Platform{}, err
+	}
+	return configPlatform(filepath.Join(rootDir, "blobs"), manifest.Config)
+}
+
+// UploadImageBlobs uploads blobs from srcDir to repo in parallel, skipping
+// the ones the registry already has and mounting them from mountFrom when
+// it is set.
+func UploadImageBlobs(client *registry.Client, repo string, blobs []pkg.Descriptor, srcDir, mountFrom string, chunkSize int64, log *slog.Logger, stater logger.Console, progress *logger.Progress) error {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 4)
+	errCh := make(chan error, len(blobs))
+	upload := func(desc pkg.Descriptor) {
+		defer wg.Done()
+		sem <- struct{}{}
+		defer func() { <-sem }()
+		digest := desc.Digest
+		report := func(n int64) {
+			progress.Update(logger.ProgressEvent{ID: digest, Action: "uploading", Current: n, Total: desc.Size})
+		}
+		defer progress.Update(logger.ProgressEvent{ID: digest, Action: "uploading", Done: true})
+		var err error
+		var result string
+		for attempt := 0; attempt < registry.MaxAttempts; attempt++ {
+			if attempt > 0 {
+				// a failed session cannot be trusted, so the blob starts over
+				wait := registry.Backoff(attempt - 1)
+				log.Warn("retrying blob upload", "digest", digest, "attempt", attempt+1, "wait", wait, "error", err)
+				stater.Warn("retrying blob upload", "digest", digest, "wait", wait.Round(time.Millisecond), "error", err)
+				time.Sleep(wait)
+			}
+			result, err = uploadBlob(client, repo, desc, srcDir, mountFrom, chunkSize, report)
+			if !registry.Retryable(err) {
+				break
+			}
+		}
+		if err != nil {
+			log.Error("error uploading blob", "digest", digest, "error", err)
+			stater.Error("error uploading blob", "digest", digest, "error", err.Error())
+			errCh <- err
+			return
+		}
+		log.Info("blob "+result, "digest", digest, "repository", repo)
+		stater.Success("blob "+result, "digest", digest)
+	}
+	for _, blob := range blobs {
+		wg.Add(1)
+		go upload(blob)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		return err
+	}
+	return nil
+}
+
+// uploadBlob pushes one blob and says what happened to it: "exists",
+// "mounted" or "uploaded".
+func uploadBlob(client *registry.Client, repo string, desc pkg.Descriptor, srcDir, mountFrom string, chunkSize int64, progress func(int64)) (string, error) {
+	exists, err := client.BlobExists(repo, desc.Digest)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "exists", nil
+	}
+	// the local copy is only needed when the registry can't mount the blob
+	if mountFrom != "" {
+		mounted, err := client.MountBlob(repo, desc.Digest, mountFrom)
+		if err != nil {
+			return "", err
+		}
+		if mounted {
+			return "mounted", nil
+		}
+	}
+	f, err := os.Open(filepath.Join(srcDir, strings.TrimPrefix(desc.Digest, "sha256:")))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("blob %s is missing from the local store, pull the image again", desc.Digest)
+		}
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if desc.Size > 0 && info.Size() != desc.Size {
+		return "", fmt.Errorf("blob %s in the local store is %d bytes, expected %d, pull the image again", desc.Digest, info.Size(), desc.Size)
+	}
+	err = client.UploadBlob(repo, desc.Digest, info.Size(), f, &registry.UploadOptions{
+		ChunkSize: chunkSize,
+		Progress:  progress,
+	})
+	if err != nil {
+		return "", err
+	}
+	return "uploaded", nil
+}
@@ -0,0 +1,119 @@
+package runtime
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/harsha3330/crun/internal/pkg"
+	"github.com/harsha3330/crun/internal/registry"
+)
+
+func TestUploadBlobOutcomes(t *testing.T) {
+	const blob = "layer contents"
+	hex := fmt.Sprintf("%x", sha256.Sum256([]byte(blob)))
+	desc := pkg.Descriptor{Digest: "sha256:" + hex, Size: int64(len(blob))}
+	srcDir := t.TempDir()
+	writeStoreFile(t, filepath.Join(srcDir, hex), blob)
+
+	tests := []struct {
+		name      string
+		has       []string // repositories the registry has the blob in
+		mountFrom string
+		want      string
+		requests  []string
+	}{
+		{"already there", []string{"app"}, "", "exists", []string{"HEAD"}},
+		{"mounted", []string{"base"}, "base", "mounted", []string{"HEAD", "POST"}},
+		{"mount declined", nil, "base", "uploaded", []string{"HEAD", "POST", "DELETE", "POST", "PUT"}},
+		{"uploaded", nil, "", "uploaded", []string{"HEAD", "POST", "PUT"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var requests []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				requests = append(requests, r.Method)
+				mu.Unlock()
+				repo, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/blobs/")
+				switch r.Method {
+				case "HEAD":
+					if !slices.Contains(tt.has, repo) {
+						w.WriteHeader(http.StatusNotFound)
+					}
+				case "POST":
+					if from := r.URL.Query().Get("from"); from != "" && slices.Contains(tt.has, from) {
+						w.WriteHeader(http.StatusCreated)
+						return
+					}
+					w.Header().Set("Location", "/v2/app/blobs/uploads/1")
+					w.WriteHeader(http.StatusAccepted)
+				case "PUT":
+					data, _ := io.ReadAll(r.Body)
+					if string(data) != blob || r.URL.Query().Get("digest") != desc.Digest {
+						w.WriteHeader(http.StatusBadRequest)
+						return
+					}
+					w.WriteHeader(http.StatusCreated)
+				}
+			}))
+			defer srv.Close()
+			client := registry.NewClient(strings.TrimPrefix(srv.URL, "http://"), registry.Options{})
+
+			got, err := uploadBlob(client, "app", desc, srcDir, tt.mountFrom, 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("blob %s, want %s", got, tt.want)
+			}
+			if strings.Join(requests, " ") != strings.Join(tt.requests, " ") {
+				t.Errorf("requests %q, want %q", requests, tt.requests)
+			}
+		})
+	}
+
+	t.Run("missing locally", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		defer srv.Close()
+		client := registry.NewClient(strings.TrimPrefix(srv.URL, "http://"), registry.Options{})
+		if err := os.Remove(filepath.Join(srcDir, hex)); err != nil {
+			t.Fatal(err)
+		}
+		_, err := uploadBlob(client, "app", desc, srcDir, "", 0, nil)
+		if err == nil || !strings.Contains(err.Error(), "pull the image again") {
+			t.Errorf("got %v", err)
+		}
+	})
+
+	t.Run("missing locally but mountable", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "POST" && r.URL.Query().Get("from") == "base" {
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer srv.Close()
+		client := registry.NewClient(strings.TrimPrefix(srv.URL, "http://"), registry.Options{})
+		if _, err := os.Stat(filepath.Join(srcDir, hex)); !os.IsNotExist(err) {
+			t.Fatalf("blob still in the local store: %v", err)
+		}
+		got, err := uploadBlob(client, "app", desc, srcDir, "base", 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "mounted" {
+			t.Errorf("blob %s, want mounted", got)
+		}
+	})
+}
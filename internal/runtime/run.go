@@ -36,10 +36,15 @@ func newContainerID(root string) (string, error) {
 			return "", err
 		}
 
-		path := filepath.Join(root, "containers", id)
-		if _, err := os.Stat(path); os.IsNotExist(err) {
+		// creating the directory claims the id, so two runs cannot get the
+		// same one
+		err = os.Mkdir(filepath.Join(root, "containers", id), 0755)
+		if err == nil {
 			return id, nil
 		}
+		if !os.IsExist(err) {
+			return "", err
+		}
 	}
 }
 
@@ -153,6 +158,9 @@ func startContainerSimple(rootfs string, args []string, env []string, logFile *o
 
 type RunOptions struct {
 	HostNetwork bool
+	// Platform selects among the platforms the image was pulled for; empty
+	// means this host.
+	Platform string
 }
 
 func Run(cfg config.Config, log *slog.Logger, stater logger.Console, image string, opts *RunOptions) error {
@@ -164,25 +172,38 @@ func Run(cfg config.Config, log *slog.Logger, stater logger.Console, image strin
 	}
 	log.Info("Starting the process for the image", "value", image)
 	stater.Step("Starting the image", "value", image)
-	repo, tag, err := parseImage(image)
-	stater.Step("Image Arguments", "repository", repo, "tag", tag)
+	ref, err := parseImage(image)
 	if err != nil {
 		log.Error(err.Error())
 		stater.Error(err.Error())
 		return err
 	}
-	manifestDigestLocation := filepath.Join(cfg.RootDir, "images", repo, "tags", tag)
-	digestData, err := os.ReadFile(manifestDigestLocation)
+	image = ref.String()
+	platform := pkg.HostPlatform()
+	if opts.Platform != "" {
+		if platform, err = pkg.ParsePlatform(opts.Platform); err != nil {
+			stater.Error(err.Error())
+			return err
+		}
+	}
+	stater.Step("Image Arguments", "repository", ref.Name(), "tag", ref.Tag, "digest", ref.Digest, "platform", platform)
+	// rmi must not remove the layers until the container records its image
+	_, storeLock, err := lockStore(cfg, stater, false)
+	if err != nil {
+		return err
+	}
+	defer storeLock.Unlock()
+	digest, err := resolveImage(cfg.RootDir, ref, platform)
 	if err != nil {
-		stater.Error("error while getting the manifest digest for the image tag", "error", err)
+		stater.Error("error while getting the manifest digest for the image", "error", err)
 		return err
 	}
-	digest := string(digestData)
-	log.Debug("got the digest for image", "repo", repo, "tag", tag, "digest", digest)
-	manifestLocation := filepath.Join(cfg.RootDir, "images", repo, "manifests", digest[7:], "manifest.json")
+	log.Debug("got the digest for image", "repo", ref.Name(), "tag", ref.Tag, "digest", digest)
+	manifestLocation := manifestPath(cfg.RootDir, ref.Name(), digest)
 	manifestData, err := os.ReadFile(manifestLocation)
 	if err != nil {
 		stater.Error("error while getting the manifests data from manifest file", "location", manifestLocation)
+		return err
 	}
 	stater.Success("got the manifests data from manifest file")
 	var ociImageManifest pkg.OCIManifest
@@ -280,6 +301,9 @@ func Run(cfg config.Config, log *slog.Logger, stater logger.Console, image strin
 	}
 	imageRefPath := filepath.Join(containerDir, "image")
 	_ = os.WriteFile(imageRefPath, []byte(image), 0644)
+	// the tag may move on, so prune needs the manifest the container runs
+	manifestRefPath := filepath.Join(containerDir, "manifest")
+	_ = os.WriteFile(manifestRefPath, []byte(ref.Name()+"@"+digest), 0644)
 
 	stater.Success("container started (detached)",
 		"container-id", containerId,
@@ -0,0 +1,396 @@
+package runtime
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/harsha3330/crun/internal/config"
+	logger "github.com/harsha3330/crun/internal/log"
+	"github.com/harsha3330/crun/internal/pkg"
+	"github.com/harsha3330/crun/internal/reference"
+)
+
+type SaveOptions struct {
+	// Format is "oci" (the default) for an OCI image layout or "docker" for
+	// the archive docker load reads.
+	Format string
+
+	// Platform saves only the manifest pulled for this "os/arch[/variant]".
+	// Otherwise an OCI layout holds every platform an image was pulled for,
+	// and a docker archive, which has room for one, the one closest to this
+	// host.
+	Platform string
+}
+
+// savedImage is one image given to Save with the manifests to write for it.
+type savedImage struct {
+	ref  reference.Reference
+	refs []platformRef
+}
+
+// layoutIndex is the index.json of an OCI image layout.
+type layoutIndex struct {
+	SchemaVersion int                `json:"schemaVersion"`
+	MediaType     string             `json:"mediaType"`
+	Manifests     []layoutDescriptor `json:"manifests"`
+}
+
+type layoutDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    layoutPlatform    `json:"platform"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type layoutPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// archiveManifest is one entry of the manifest.json of a docker archive.
+type archiveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// Save writes pulled images to a tarball at out, straight from
+// RootDir/blobs and the stored manifests, for moving them to hosts that
+// cannot reach a registry. Images that share blobs share them in the
+// tarball too. The tarball is written next to out and renamed into place,
+// so a failed save leaves nothing behind.
+func Save(cfg config.Config, log *slog.Logger, stater logger.Console, images []string, out string, opts *SaveOptions) error {
+	if opts == nil {
+		opts = &SaveOptions{}
+	}
+	if opts.Format == "" {
+		opts.Format = "oci"
+	}
+	if opts.Format != "oci" && opts.Format != "docker" {
+		err := fmt.Errorf("unknown format %q: want oci or docker", opts.Format)
+		stater.Error(err.Error())
+		return err
+	}
+	var want *pkg.Platform
+	if opts.Platform != "" {
+		platform, err := pkg.ParsePlatform(opts.Platform)
+		if err != nil {
+			stater.Error(err.Error())
+			return err
+		}
+		want = &platform
+	} else if opts.Format == "docker" {
+		platform := pkg.HostPlatform()
+		want = &platform
+	}
+
+	_, storeLock, err := lockStore(cfg, stater, false)
+	if err != nil {
+		return err
+	}
+	defer storeLock.Unlock()
+
+	var saved []savedImage
+	for _, image := range images {
+		ref, err := parseImage(image)
+		if err != nil {
+			stater.Error(err.Error())
+			return err
+		}
+		refs, err := localManifests(cfg.RootDir, ref)
+		if err != nil {
+			stater.Error("image not available locally", "image", ref.String(), "error", err)
+			return err
+		}
+		if want != nil {
+			candidates := make([]pkg.Platform, len(refs))
+			for i, r := range refs {
+				candidates[i] = r.Platform
+			}
+			best := pkg.BestPlatform(*want, candidates)
+			if best < 0 {
+				err := fmt.Errorf("image %s is not pulled for %s", ref, want)
+				stater.Error(err.Error())
+				return err
+			}
+			refs = refs[best : best+1]
+		}
+		saved = append(saved, savedImage{ref: ref, refs: refs})
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(out), "."+filepath.Base(out)+".*.tmp")
+	if err != nil {
+		stater.Error("failed to create the output file", "error", err)
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	if opts.Format == "docker" {
+		err = writeDockerArchive(cfg.RootDir, tw, saved, filepath.Dir(out), stater)
+	} else {
+		err = writeOCILayout(cfg.RootDir, tw, saved, stater)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		// CreateTemp makes the file 0600, where a saved image is usually
+		// meant to be copied around
+		err = f.Chmod(0644)
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), out)
+	}
+	if err != nil {
+		stater.Error("failed to save the images", "file", out, "error", err)
+		return err
+	}
+	if info, err := os.Stat(out); err == nil {
+		log.Info("saved images", "images", len(saved), "file", out, "format", opts.Format, "bytes", info.Size())
+		stater.Success("images saved", "file", out, "format", opts.Format, "size", logger.FormatBytes(info.Size()))
+	}
+	return nil
+}
+
+// writeOCILayout writes an OCI image layout: oci-layout, index.json with
+// one entry per image and platform, and every manifest, config and layer
+// blob, byte for byte, under blobs/sha256/.
+func writeOCILayout(rootDir string, tw *tar.Writer, saved []savedImage, stater logger.Console) error {
+	if err := writeTarFile(tw, "oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return err
+	}
+	for _, dir := range []string{"blobs/", "blobs/sha256/"} {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0755, ModTime: time.Now()}); err != nil {
+			return err
+		}
+	}
+	blobDir := filepath.Join(rootDir, "blobs")
+	written := make(map[string]bool)
+	writeBlob := func(digest string) error {
+		blobHex := strings.TrimPrefix(digest, "sha256:")
+		if written[blobHex] {
+			return nil
+		}
+		written[blobHex] = true
+		return copyTarFile(tw, "blobs/sha256/"+blobHex, filepath.Join(blobDir, blobHex))
+	}
+
+	index := layoutIndex{SchemaVersion: 2, MediaType: pkg.MediaTypeOCIIndex, Manifests: []layoutDescriptor{}}
+	for _, s := range saved {
+		stater.Step("saving the image", "image", s.ref.String(), "platforms", len(s.refs))
+		for _, r := range s.refs {
+			data, err := os.ReadFile(manifestPath(rootDir, s.ref.Name(), r.Manifest))
+			if err != nil {
+				return err
+			}
+			mediaType, err := pkg.ManifestMediaType("", data)
+			if err != nil {
+				return fmt.Errorf("manifest %s: %w", r.Manifest, err)
+			}
+			manifest, err := pkg.DecodeManifestAuto(data)
+			if err != nil {
+				return fmt.Errorf("manifest %s: %w", r.Manifest, err)
+			}
+			manifestHex := strings.TrimPrefix(r.Manifest, "sha256:")
+			if !written[manifestHex] {
+				written[manifestHex] = true
+				if err := writeTarFile(tw, "blobs/sha256/"+manifestHex, data); err != nil {
+					return err
+				}
+			}
+			if err := writeBlob(manifest.Config.Digest); err != nil {
+				return err
+			}
+			for _, l := range manifest.Layers {
+				if err := writeBlob(l.Digest); err != nil {
+					return err
+				}
+			}
+			annotations := map[string]string{"io.containerd.image.name": s.ref.String()}
+			if s.ref.Digest == "" {
+				annotations["org.opencontainers.image.ref.name"] = s.ref.Tag
+			}
+			index.Manifests = append(index.Manifests, layoutDescriptor{
+				MediaType:   mediaType,
+				Digest:      r.Manifest,
+				Size:        int64(len(data)),
+				Platform:    layoutPlatform{Architecture: r.Platform.Arch, OS: r.Platform.OS, Variant: r.Platform.Variant},
+				Annotations: annotations,
+			})
+		}
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return writeTarFile(tw, "index.json", data)
+}
+
+// writeDockerArchive writes the archive docker save does: manifest.json
+// with one entry per image config, the legacy repositories file mapping
+// each tag to its top layer, <config hex>.json and, since docker expects
+// them uncompressed, every layer as <diff id hex>/layer.tar.
+// Layers are decompressed into a scratch file in tmpDir first, as a tar
+// header needs their size up front.
+func writeDockerArchive(rootDir string, tw *tar.Writer, saved []savedImage, tmpDir string, stater logger.Console) error {
+	blobDir := filepath.Join(rootDir, "blobs")
+	written := make(map[string]bool)
+	var entries []*archiveManifest
+	byConfig := make(map[string]*archiveManifest)
+	repositories := make(map[string]map[string]string)
+	for _, s := range saved {
+		stater.Step("saving the image", "image", s.ref.String(), "platform", s.refs[0].Platform)
+		data, err := os.ReadFile(manifestPath(rootDir, s.ref.Name(), s.refs[0].Manifest))
+		if err != nil {
+			return err
+		}
+		manifest, err := pkg.DecodeManifestAuto(data)
+		if err != nil {
+			return fmt.Errorf("manifest %s: %w", s.refs[0].Manifest, err)
+		}
+		configHex := strings.TrimPrefix(manifest.Config.Digest, "sha256:")
+		entry := byConfig[configHex]
+		if entry == nil {
+			configData, err := os.ReadFile(filepath.Join(blobDir, configHex))
+			if err != nil {
+				return err
+			}
+			var imageConfig pkg.OCIImageConfig
+			if err := json.Unmarshal(configData, &imageConfig); err != nil {
+				return fmt.Errorf("image config %s: %w", manifest.Config.Digest, err)
+			}
+			if len(imageConfig.RootFS.DiffIDs) != len(manifest.Layers) {
+				return fmt.Errorf("image config %s lists %d diff ids for %d layers", manifest.Config.Digest, len(imageConfig.RootFS.DiffIDs), len(manifest.Layers))
+			}
+			entry = &archiveManifest{Config: configHex + ".json", RepoTags: []string{}}
+			if err := writeTarFile(tw, entry.Config, configData); err != nil {
+				return err
+			}
+			for i, l := range manifest.Layers {
+				diffHex := strings.TrimPrefix(imageConfig.RootFS.DiffIDs[i], "sha256:")
+				name := diffHex + "/layer.tar"
+				entry.Layers = append(entry.Layers, name)
+				if written[diffHex] {
+					continue
+				}
+				written[diffHex] = true
+				if err := writeLayerTar(tw, name, filepath.Join(blobDir, strings.TrimPrefix(l.Digest, "sha256:")), l.MediaType, diffHex, tmpDir); err != nil {
+					return fmt.Errorf("layer %s: %w", l.Digest, err)
+				}
+			}
+			byConfig[configHex] = entry
+			entries = append(entries, entry)
+		}
+		if s.ref.Digest != "" {
+			continue
+		}
+		repo := familiarName(s.ref.Name())
+		if tag := repo + ":" + s.ref.Tag; !slices.Contains(entry.RepoTags, tag) {
+			entry.RepoTags = append(entry.RepoTags, tag)
+		}
+		if len(entry.Layers) > 0 {
+			if repositories[repo] == nil {
+				repositories[repo] = make(map[string]string)
+			}
+			repositories[repo][s.ref.Tag] = path.Dir(entry.Layers[len(entry.Layers)-1])
+		}
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "manifest.json", data); err != nil {
+		return err
+	}
+	if len(repositories) == 0 {
+		return nil
+	}
+	if data, err = json.Marshal(repositories); err != nil {
+		return err
+	}
+	return writeTarFile(tw, "repositories", data)
+}
+
+// writeLayerTar writes the uncompressed tar of the layer blob at path as
+// name, checking it against diffHex.
+func writeLayerTar(tw *tar.Writer, name, path, mediaType, diffHex, tmpDir string) error {
+	blob, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	r, err := pkg.NewLayerReader(blob, mediaType)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	tmp, err := os.CreateTemp(tmpDir, ".layer-*.tar")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != diffHex {
+		return fmt.Errorf("uncompressed layer is sha256:%s, the image config says sha256:%s", got, diffHex)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: filepath.Dir(name) + "/", Mode: 0755, ModTime: time.Now()}); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: size, ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, tmp)
+	return err
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// copyTarFile writes the file at path into the tarball as name.
+func copyTarFile(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,220 @@
+package runtime
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/harsha3330/crun/internal/config"
+	logger "github.com/harsha3330/crun/internal/log"
+	"github.com/harsha3330/crun/internal/pkg"
+	"github.com/harsha3330/crun/internal/reference"
+)
+
+// pulledImage is an image put in a store the way pull leaves it.
+type pulledImage struct {
+	manifest, config, layer []byte
+	// diffID is the digest of the uncompressed layer.
+	diffID   string
+	layerTar string
+}
+
+// storePulledImage stores a one-layer linux/amd64 image and tags it with
+// each of images.
+func storePulledImage(t *testing.T, root string, images ...string) pulledImage {
+	t.Helper()
+	var img pulledImage
+	img.layerTar = layerTar(t, map[string]string{"etc/hostname": "crun\n"})
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	io.WriteString(zw, img.layerTar)
+	zw.Close()
+	img.layer = gz.Bytes()
+	img.diffID = sha256Hex(img.layerTar)
+	img.config = []byte(`{"architecture":"amd64","os":"linux","created":"2024-01-01T00:00:00Z","rootfs":{"type":"layers","diff_ids":["` + img.diffID + `"]}}`)
+	img.manifest = []byte(`{"schemaVersion":2,"mediaType":"` + pkg.MediaTypeOCIManifest + `",` +
+		`"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"` + sha256Hex(string(img.config)) + `","size":` + strconv.Itoa(len(img.config)) + `},` +
+		`"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"` + sha256Hex(string(img.layer)) + `","size":` + strconv.Itoa(len(img.layer)) + `}]}`)
+
+	writeStoreFile(t, filepath.Join(root, "blobs", sha256Hex(string(img.config))[7:]), string(img.config))
+	writeStoreFile(t, filepath.Join(root, "blobs", sha256Hex(string(img.layer))[7:]), string(img.layer))
+	writeStoreFile(t, filepath.Join(root, storeVersionFile), strconv.Itoa(storeVersion))
+	for _, image := range images {
+		ref, err := reference.Parse(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeStoreFile(t, manifestPath(root, ref.Name(), sha256Hex(string(img.manifest))), string(img.manifest))
+		writeStoreFile(t, tagPath(root, ref), "linux/amd64 "+sha256Hex(string(img.manifest)))
+	}
+	return img
+}
+
+// readTarball returns the regular files in the tarball at path by name.
+func readTarball(t *testing.T, path string) map[string][]byte {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	files := make(map[string][]byte)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = data
+	}
+}
+
+func TestSaveOCILayout(t *testing.T) {
+	root := t.TempDir()
+	cfg := config.Config{RootDir: root}
+	img := storePulledImage(t, root, "app:1", "app:2")
+	out := filepath.Join(t.TempDir(), "app.tar")
+	if err := Save(cfg, slog.New(slog.DiscardHandler), logger.Console{}, []string{"app:1", "app:2"}, out, nil); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(out); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("archive mode %v, %v; want 0644", info.Mode(), err)
+	}
+
+	files := readTarball(t, out)
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	want := []string{
+		"blobs/sha256/" + sha256Hex(string(img.config))[7:],
+		"blobs/sha256/" + sha256Hex(string(img.layer))[7:],
+		"blobs/sha256/" + sha256Hex(string(img.manifest))[7:],
+		"index.json",
+		"oci-layout",
+	}
+	slices.Sort(want)
+	if !slices.Equal(names, want) {
+		t.Fatalf("archive holds %q, want %q", names, want)
+	}
+	for blob, data := range map[string][]byte{"manifest": img.manifest, "config": img.config, "layer": img.layer} {
+		if !bytes.Equal(files["blobs/sha256/"+sha256Hex(string(data))[7:]], data) {
+			t.Errorf("the %s blob was not saved as pulled", blob)
+		}
+	}
+
+	var index layoutIndex
+	if err := json.Unmarshal(files["index.json"], &index); err != nil {
+		t.Fatal(err)
+	}
+	if index.SchemaVersion != 2 || index.MediaType != pkg.MediaTypeOCIIndex || len(index.Manifests) != 2 {
+		t.Fatalf("index.json: %s", files["index.json"])
+	}
+	for i, tag := range []string{"1", "2"} {
+		m := index.Manifests[i]
+		wantAnnotations := map[string]string{
+			"io.containerd.image.name":          "docker.io/library/app:" + tag,
+			"org.opencontainers.image.ref.name": tag,
+		}
+		if m.Digest != sha256Hex(string(img.manifest)) || m.Size != int64(len(img.manifest)) || m.MediaType != pkg.MediaTypeOCIManifest ||
+			m.Platform != (layoutPlatform{Architecture: "amd64", OS: "linux", Variant: "v1"}) || !reflect.DeepEqual(m.Annotations, wantAnnotations) {
+			t.Errorf("index entry %d: %+v", i, m)
+		}
+	}
+}
+
+func TestSaveDockerArchive(t *testing.T) {
+	root := t.TempDir()
+	cfg := config.Config{RootDir: root}
+	img := storePulledImage(t, root, "app:1", "app:2", "ghcr.io/org/tool:v1")
+	out := filepath.Join(t.TempDir(), "app.tar")
+	err := Save(cfg, slog.New(slog.DiscardHandler), logger.Console{}, []string{"app:1", "app:2", "ghcr.io/org/tool:v1"}, out, &SaveOptions{Format: "docker", Platform: "linux/amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(out); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("archive mode %v, %v; want 0644", info.Mode(), err)
+	}
+
+	files := readTarball(t, out)
+	configHex, diffHex := sha256Hex(string(img.config))[7:], img.diffID[7:]
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	want := []string{configHex + ".json", diffHex + "/layer.tar", "manifest.json", "repositories"}
+	slices.Sort(want)
+	if !slices.Equal(names, want) {
+		t.Fatalf("archive holds %q, want %q", names, want)
+	}
+	if !bytes.Equal(files[configHex+".json"], img.config) {
+		t.Error("config not saved as pulled")
+	}
+	if string(files[diffHex+"/layer.tar"]) != img.layerTar {
+		t.Error("layer.tar is not the uncompressed layer")
+	}
+
+	var manifests []archiveManifest
+	if err := json.Unmarshal(files["manifest.json"], &manifests); err != nil {
+		t.Fatal(err)
+	}
+	wantManifests := []archiveManifest{{
+		Config:   configHex + ".json",
+		RepoTags: []string{"app:1", "app:2", "ghcr.io/org/tool:v1"},
+		Layers:   []string{diffHex + "/layer.tar"},
+	}}
+	if !reflect.DeepEqual(manifests, wantManifests) {
+		t.Errorf("manifest.json: %s", files["manifest.json"])
+	}
+
+	var repositories map[string]map[string]string
+	if err := json.Unmarshal(files["repositories"], &repositories); err != nil {
+		t.Fatal(err)
+	}
+	wantRepositories := map[string]map[string]string{
+		"app":              {"1": diffHex, "2": diffHex},
+		"ghcr.io/org/tool": {"v1": diffHex},
+	}
+	if !reflect.DeepEqual(repositories, wantRepositories) {
+		t.Errorf("repositories: %s", files["repositories"])
+	}
+}
+
+func TestSaveFailureLeavesNothing(t *testing.T) {
+	root := t.TempDir()
+	cfg := config.Config{RootDir: root}
+	img := storePulledImage(t, root, "app:1")
+	// a layer blob lost from the store
+	if err := os.Remove(filepath.Join(root, "blobs", sha256Hex(string(img.layer))[7:])); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := Save(cfg, slog.New(slog.DiscardHandler), logger.Console{}, []string{"app:1"}, filepath.Join(dir, "app.tar"), nil); err == nil {
+		t.Fatal("saved an image with a missing layer")
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		t.Errorf("left %s", e.Name())
+	}
+}
@@ -0,0 +1,444 @@
+package runtime
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	goruntime "runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/harsha3330/crun/internal/config"
+	logger "github.com/harsha3330/crun/internal/log"
+	"github.com/harsha3330/crun/internal/pkg"
+	"github.com/harsha3330/crun/internal/reference"
+)
+
+// Images are stored by canonical repository name, so docker.io/library/nginx
+// lives in images/docker.io/library/nginx/{_tags,_digests,_manifests}. The
+// metadata directories start with '_', which no repository path component
+// can, so a repository such as myorg/tags is never mistaken for one. Both
+// _tags/<tag> and _digests/<hex> record, one "os/arch/variant digest" line
+// per platform pulled, the platform manifest the reference resolved to.
+// Files written before platforms were recorded hold a bare digest, which was
+// pulled for the host's os/arch.
+//
+// The store records its layout version in store-version. Stores without one
+// kept each repository under the name it was pulled by (images/nginx), with
+// tags/ and manifests/ directories, and are migrated once, the first time
+// the store is locked.
+
+const (
+	tagsDir      = "_tags"
+	digestsDir   = "_digests"
+	manifestsDir = "_manifests"
+
+	storeVersion     = 1
+	storeVersionFile = "store-version"
+)
+
+func parseImage(image string) (reference.Reference, error) {
+	return reference.Parse(image)
+}
+
+func repoDir(rootDir, name string) string {
+	return filepath.Join(rootDir, "images", filepath.FromSlash(name))
+}
+
+func tagPath(rootDir string, ref reference.Reference) string {
+	return filepath.Join(repoDir(rootDir, ref.Name()), tagsDir, ref.Tag)
+}
+
+func digestPath(rootDir string, ref reference.Reference) string {
+	return filepath.Join(repoDir(rootDir, ref.Name()), digestsDir, strings.TrimPrefix(ref.Digest, "sha256:"))
+}
+
+// refPath returns the file that records what ref resolved to when it was
+// pulled. A digest takes precedence over a tag, as it does for the registry.
+func refPath(rootDir string, ref reference.Reference) string {
+	if ref.Digest != "" {
+		return digestPath(rootDir, ref)
+	}
+	return tagPath(rootDir, ref)
+}
+
+// platformRef is one line of a tag or digest file.
+type platformRef struct {
+	Platform pkg.Platform
+	Manifest string
+}
+
+func readRefFile(path string) ([]platformRef, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var refs []platformRef
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 1:
+			legacy := pkg.NormalizePlatform(pkg.Platform{OS: goruntime.GOOS, Arch: goruntime.GOARCH})
+			refs = append(refs, platformRef{Platform: legacy, Manifest: fields[0]})
+		case 2:
+			platform, err := pkg.ParsePlatform(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			refs = append(refs, platformRef{Platform: platform, Manifest: fields[1]})
+		}
+	}
+	return refs, nil
+}
+
+// recordRef notes that ref resolved to manifest for platform, keeping what
+// it resolved to for other platforms.
+func recordRef(rootDir string, ref reference.Reference, platform pkg.Platform, manifest string) error {
+	path := refPath(rootDir, ref)
+	refs, err := readRefFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	refs = slices.DeleteFunc(refs, func(r platformRef) bool { return r.Platform == platform })
+	refs = append(refs, platformRef{Platform: platform, Manifest: manifest})
+	return writeRefFile(path, refs)
+}
+
+func writeRefFile(path string, refs []platformRef) error {
+	var b strings.Builder
+	for _, r := range refs {
+		fmt.Fprintf(&b, "%s %s\n", r.Platform, r.Manifest)
+	}
+	return pkg.SaveFile(path, []byte(b.String()))
+}
+
+// resolveImage returns the digest of the platform manifest ref points at
+// that best suits platform. A digest that names a stored manifest directly
+// resolves to itself, so an image pulled by tag can also be run by its
+// manifest digest.
+func resolveImage(rootDir string, ref reference.Reference, platform pkg.Platform) (string, error) {
+	refs, err := readRefFile(refPath(rootDir, ref))
+	if err == nil {
+		candidates := make([]pkg.Platform, len(refs))
+		pulled := make([]string, len(refs))
+		for i, r := range refs {
+			candidates[i], pulled[i] = r.Platform, r.Platform.String()
+		}
+		if best := pkg.BestPlatform(platform, candidates); best >= 0 {
+			return refs[best].Manifest, nil
+		}
+		return "", fmt.Errorf("image %s is not pulled for %s (pulled: %s)", ref, platform, strings.Join(pulled, ", "))
+	}
+	if ref.Digest != "" && os.IsNotExist(err) {
+		if _, serr := os.Stat(manifestPath(rootDir, ref.Name(), ref.Digest)); serr == nil {
+			return ref.Digest, nil
+		}
+	}
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("image not found: %s", ref)
+	}
+	return "", err
+}
+
+// storedRef is one tag or digest pin of a repository together with the
+// platform manifest it resolves to.
+type storedRef struct {
+	Tag      string
+	Digest   string
+	Platform pkg.Platform
+	Manifest string
+}
+
+// listRefs returns the tags and digest pins recorded for a repository, one
+// entry per platform.
+func listRefs(rootDir, name string) []storedRef {
+	var refs []storedRef
+	dir := repoDir(rootDir, name)
+	for _, kind := range []string{tagsDir, digestsDir} {
+		entries, _ := os.ReadDir(filepath.Join(dir, kind))
+		for _, e := range entries {
+			if e.IsDir() || strings.HasSuffix(e.Name(), ".tmp") {
+				continue
+			}
+			lines, err := readRefFile(filepath.Join(dir, kind, e.Name()))
+			if err != nil {
+				continue
+			}
+			for _, line := range lines {
+				r := storedRef{Platform: line.Platform, Manifest: line.Manifest}
+				if kind == tagsDir {
+					r.Tag = e.Name()
+				} else {
+					r.Digest = "sha256:" + e.Name()
+				}
+				refs = append(refs, r)
+			}
+		}
+	}
+	return refs
+}
+
+func manifestDir(rootDir, name, digest string) string {
+	return filepath.Join(repoDir(rootDir, name), manifestsDir, strings.TrimPrefix(digest, "sha256:"))
+}
+
+func manifestPath(rootDir, name, digest string) string {
+	return filepath.Join(manifestDir(rootDir, name, digest), "manifest.json")
+}
+
+// ImageMetadata is what the store records about a manifest beyond its
+// content, in _manifests/<hex>/meta.json next to it. Pulling the manifest
+// again rewrites it.
+type ImageMetadata struct {
+	// PulledAt is when the pull finished.
+	PulledAt time.Time `json:"pulledAt"`
+	// Reference is the canonical reference that was pulled.
+	Reference string `json:"reference"`
+	// Registry is the registry the reference names, and Endpoint the host
+	// the manifest actually came from, which differs for mirrors.
+	Registry string `json:"registry"`
+	Endpoint string `json:"endpoint"`
+}
+
+func metadataPath(rootDir, name, digest string) string {
+	return filepath.Join(manifestDir(rootDir, name, digest), "meta.json")
+}
+
+func saveMetadata(rootDir, name, digest string, meta ImageMetadata) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return pkg.SaveFile(metadataPath(rootDir, name, digest), data)
+}
+
+// readMetadata returns nil, not an error, for manifests pulled before
+// metadata was recorded.
+func readMetadata(rootDir, name, digest string) (*ImageMetadata, error) {
+	data, err := os.ReadFile(metadataPath(rootDir, name, digest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var meta ImageMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("%s: %w", metadataPath(rootDir, name, digest), err)
+	}
+	return &meta, nil
+}
+
+// listRepositories returns the canonical names of all repositories in the
+// store. A repository is any directory under images/ holding _tags/,
+// _digests/ or _manifests/.
+func listRepositories(rootDir string) []string {
+	return findRepositories(rootDir, isMetadataDir)
+}
+
+func isMetadataDir(path string) bool {
+	switch filepath.Base(path) {
+	case tagsDir, digestsDir, manifestsDir:
+		return true
+	}
+	return false
+}
+
+// findRepositories returns the paths under images/ of the directories with
+// a metadata directory in them, as told by isMeta, without looking inside
+// those.
+func findRepositories(rootDir string, isMeta func(path string) bool) []string {
+	imagesDir := filepath.Join(rootDir, "images")
+	var names []string
+	_ = filepath.WalkDir(imagesDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if path != imagesDir && isMeta(path) {
+			return filepath.SkipDir
+		}
+		entries, _ := os.ReadDir(path)
+		for _, e := range entries {
+			if e.IsDir() && isMeta(filepath.Join(path, e.Name())) {
+				rel, err := filepath.Rel(imagesDir, path)
+				if err == nil {
+					names = append(names, filepath.ToSlash(rel))
+				}
+				break
+			}
+		}
+		return nil
+	})
+	return names
+}
+
+// lockStore takes the store lock, shared by commands that read or add to the
+// store and exclusive for those that remove from it. It returns the locker
+// too, for the blob and layer locks taken under it. A store in an older
+// layout is migrated first.
+func lockStore(cfg config.Config, stater logger.Console, exclusive bool) (*pkg.Locker, *pkg.Lock, error) {
+	locks := pkg.NewLocker(cfg.RootDir)
+	locks.OnWait = func(name string) {
+		stater.Step("waiting for another crun process", "lock", name)
+	}
+	take := locks.Shared
+	if exclusive {
+		take = locks.Exclusive
+	}
+	if readStoreVersion(cfg.RootDir) < storeVersion {
+		// nobody may be reading a repository while it moves
+		lock, err := locks.Exclusive(pkg.StoreLock)
+		if err != nil {
+			stater.Error("error locking the image store", "error", err)
+			return nil, nil, err
+		}
+		err = migrateStore(cfg.RootDir)
+		lock.Unlock()
+		if err != nil {
+			stater.Error("error migrating the image store", "error", err)
+			return nil, nil, err
+		}
+	}
+	storeLock, err := take(pkg.StoreLock)
+	if err != nil {
+		stater.Error("error locking the image store", "error", err)
+		return nil, nil, err
+	}
+	return locks, storeLock, nil
+}
+
+// readStoreVersion returns the layout version of the store, 0 for stores
+// written before it was recorded.
+func readStoreVersion(rootDir string) int {
+	data, err := os.ReadFile(filepath.Join(rootDir, storeVersionFile))
+	if err != nil {
+		return 0
+	}
+	var v int
+	if _, err := fmt.Sscanf(string(data), "%d", &v); err != nil {
+		return 0
+	}
+	return v
+}
+
+// migrateStore brings a store without a version up to storeVersion and
+// records it. Call it with the store lock held exclusively.
+func migrateStore(rootDir string) error {
+	if readStoreVersion(rootDir) >= storeVersion {
+		// another process migrated it while this one waited for the lock
+		return nil
+	}
+	legacy := legacyRepositories(rootDir)
+	if err := migrateLegacyRepositories(rootDir, legacy); err != nil {
+		return err
+	}
+	err := pkg.SaveFile(filepath.Join(rootDir, storeVersionFile), []byte(fmt.Sprintf("%d\n", storeVersion)))
+	if err != nil && len(legacy) == 0 && errors.Is(err, fs.ErrPermission) {
+		// nothing needed moving, and the next command that may write to
+		// the store records the version
+		return nil
+	}
+	return err
+}
+
+// legacyRepositories returns the repositories of a store without a version,
+// which kept them in tags/, digests/ and manifests/ directories under the
+// name they were pulled by (images/nginx for docker.io/library/nginx).
+func legacyRepositories(rootDir string) []string {
+	return findRepositories(rootDir, isLegacyMetadataDir)
+}
+
+// isLegacyMetadataDir tells an old metadata directory from a repository
+// path component of the same name by what it holds: tags/ and digests/ hold
+// files, manifests/ directories named by digest. The images/ghcr.io/tags
+// of ghcr.io/tags/app holds the directory app.
+func isLegacyMetadataDir(path string) bool {
+	kind := filepath.Base(path)
+	if kind != "tags" && kind != "digests" && kind != "manifests" {
+		return false
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil || len(entries) == 0 {
+		return false
+	}
+	for _, e := range entries {
+		if kind == "manifests" {
+			if !e.IsDir() || !digestHexRe.MatchString(e.Name()) {
+				return false
+			}
+		} else if e.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+var digestHexRe = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// migrateLegacyRepositories moves each legacy repository to its canonical
+// name and renames its metadata directories. Names were stored as typed,
+// which for the Docker Hub images crun could pull never started with a
+// registry host; names that do were written in the canonical layout and
+// only have their directories renamed. When the canonical repository
+// already exists the two are merged: its tags are newer and win, and a
+// manifest is the same wherever it is stored.
+func migrateLegacyRepositories(rootDir string, names []string) error {
+	// the canonical ones first, so their newer tags are in place before
+	// the others are merged into them
+	var canonicalNames, typedNames []string
+	for _, name := range names {
+		if hasRegistryHost(name) {
+			canonicalNames = append(canonicalNames, name)
+		} else {
+			typedNames = append(typedNames, name)
+		}
+	}
+	for _, name := range append(canonicalNames, typedNames...) {
+		canonical := name
+		if !hasRegistryHost(name) {
+			ref, err := reference.Parse(name)
+			if err != nil {
+				// no reference can name it, now or before
+				continue
+			}
+			canonical = ref.Name()
+		}
+		from, to := repoDir(rootDir, name), repoDir(rootDir, canonical)
+		for _, dirs := range [][2]string{{"tags", tagsDir}, {"digests", digestsDir}, {"manifests", manifestsDir}} {
+			old, sub := dirs[0], dirs[1]
+			entries, _ := os.ReadDir(filepath.Join(from, old))
+			for _, e := range entries {
+				src, dst := filepath.Join(from, old, e.Name()), filepath.Join(to, sub, e.Name())
+				if _, err := os.Lstat(dst); err == nil || strings.HasSuffix(e.Name(), ".tmp") {
+					if err := os.RemoveAll(src); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+					return err
+				}
+				if err := os.Rename(src, dst); err != nil {
+					return err
+				}
+			}
+			if err := os.Remove(filepath.Join(from, old)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		cleanEmptyParents(rootDir, name)
+	}
+	return nil
+}
+
+// hasRegistryHost reports whether the first component of a repository name
+// is a registry host rather than part of a Docker Hub repository.
+func hasRegistryHost(name string) bool {
+	first, _, _ := strings.Cut(name, "/")
+	return strings.ContainsAny(first, ".:") || first == "localhost"
+}
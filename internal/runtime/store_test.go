@@ -0,0 +1,184 @@
+package runtime
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/harsha3330/crun/internal/config"
+	logger "github.com/harsha3330/crun/internal/log"
+	"github.com/harsha3330/crun/internal/pkg"
+	"github.com/harsha3330/crun/internal/reference"
+)
+
+func writeStoreFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// storeImage records name:tag as pulled for linux/amd64, as pull does in a
+// store at the current version.
+func storeImage(t *testing.T, root, image, manifestHex string) {
+	t.Helper()
+	ref, err := reference.Parse(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := `{"schemaVersion":2,"config":{"digest":"sha256:` + strings.Repeat("d", 64) + `"},"layers":[]}`
+	writeStoreFile(t, manifestPath(root, ref.Name(), "sha256:"+manifestHex), manifest)
+	writeStoreFile(t, tagPath(root, ref), "linux/amd64 sha256:"+manifestHex)
+	writeStoreFile(t, filepath.Join(root, storeVersionFile), strconv.Itoa(storeVersion))
+}
+
+func listedImages(t *testing.T, cfg config.Config) []string {
+	t.Helper()
+	images, err := ImageList(cfg, logger.Console{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for _, img := range images {
+		listed = append(listed, img.Reference())
+	}
+	slices.Sort(listed)
+	return listed
+}
+
+func TestListRepositoriesWithMetadataNames(t *testing.T) {
+	root := t.TempDir()
+	names := []string{
+		"docker.io/myorg/manifests",
+		"docker.io/myorg/tags",
+		"docker.io/tags/digests",
+		"ghcr.io/tags/app",
+		"ghcr.io/tags",
+		"localhost:5000/manifests/tags/digests",
+	}
+	for i, name := range names {
+		storeImage(t, root, name+":1", strings.Repeat(string(rune('a'+i)), 64))
+	}
+
+	got := listRepositories(root)
+	slices.Sort(got)
+	want := slices.Sorted(slices.Values(names))
+	if !slices.Equal(got, want) {
+		t.Errorf("listRepositories = %q, want %q", got, want)
+	}
+
+	var wantImages []string
+	for _, name := range want {
+		wantImages = append(wantImages, name+":1")
+	}
+	slices.Sort(wantImages)
+	if listed := listedImages(t, config.Config{RootDir: root}); !slices.Equal(listed, wantImages) {
+		t.Errorf("listed %q, want %q", listed, wantImages)
+	}
+	report, err := Prune(config.Config{RootDir: root}, slog.New(slog.DiscardHandler), logger.Console{}, &PruneOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range report.Items {
+		t.Errorf("prune would remove %s %s", item.Kind, item.Name)
+	}
+}
+
+func TestLegacyRepositoriesMoveToCanonicalNames(t *testing.T) {
+	root := t.TempDir()
+	cfg := config.Config{RootDir: root}
+	oldHex, newHex, appHex := strings.Repeat("a", 64), strings.Repeat("b", 64), strings.Repeat("c", 64)
+	manifest := `{"schemaVersion":2,"config":{"digest":"sha256:` + strings.Repeat("d", 64) + `"},"layers":[]}`
+
+	// as crun stored them before references were canonicalized
+	writeStoreFile(t, filepath.Join(root, "images/alpine/tags/3.19"), "sha256:"+oldHex)
+	writeStoreFile(t, filepath.Join(root, "images/alpine/tags/3.18"), "sha256:"+oldHex)
+	writeStoreFile(t, filepath.Join(root, "images/alpine/manifests", oldHex, "manifest.json"), manifest)
+	writeStoreFile(t, filepath.Join(root, "images/user/app/tags/v1"), "sha256:"+appHex)
+	writeStoreFile(t, filepath.Join(root, "images/user/app/manifests", appHex, "manifest.json"), manifest)
+	// and 3.19 pulled again since under the canonical name, before the
+	// metadata directories were renamed
+	writeStoreFile(t, filepath.Join(root, "images/docker.io/library/alpine/tags/3.19"), "linux/amd64 sha256:"+newHex)
+	writeStoreFile(t, filepath.Join(root, "images/docker.io/library/alpine/manifests", newHex, "manifest.json"), manifest)
+
+	want := []string{
+		"docker.io/library/alpine:3.18",
+		"docker.io/library/alpine:3.19",
+		"docker.io/user/app:v1",
+	}
+	if listed := listedImages(t, cfg); !slices.Equal(listed, want) {
+		t.Errorf("listed %q, want %q", listed, want)
+	}
+	if got := legacyRepositories(root); len(got) != 0 {
+		t.Errorf("legacy repositories left: %q", got)
+	}
+	for _, dir := range []string{"images/alpine", "images/user", "images/docker.io/library/alpine/tags"} {
+		if _, err := os.Stat(filepath.Join(root, dir)); !os.IsNotExist(err) {
+			t.Errorf("%s is still there: %v", dir, err)
+		}
+	}
+	if v := readStoreVersion(root); v != storeVersion {
+		t.Errorf("store version %d, want %d", v, storeVersion)
+	}
+
+	ref, _ := reference.Parse("alpine:3.19")
+	if digest, err := resolveImage(root, ref, pkg.NormalizePlatform(pkg.Platform{OS: "linux", Arch: "amd64"})); err != nil || digest != "sha256:"+newHex {
+		t.Errorf("alpine:3.19 resolves to %q, %v; want the newer sha256:%s", digest, err, newHex)
+	}
+	if _, err := os.Stat(manifestPath(root, "docker.io/library/alpine", "sha256:"+oldHex)); err != nil {
+		t.Errorf("the manifest legacy tags point at did not move: %v", err)
+	}
+	if err := RemoveImage(cfg, logger.Console{}, "user/app:v1"); err != nil {
+		t.Errorf("rmi of a legacy image: %v", err)
+	}
+}
+
+func TestCanonicalRepositoriesAreNotMigrated(t *testing.T) {
+	root := t.TempDir()
+	cfg := config.Config{RootDir: root}
+	manifest := `{"schemaVersion":2,"config":{"digest":"sha256:` + strings.Repeat("d", 64) + `"},"layers":[]}`
+	// repositories stored under their canonical name before the metadata
+	// directories were renamed; only those move
+	for i, name := range []string{"ghcr.io/tags/app", "localhost:5000/app", "registry.example.com/nginx"} {
+		hex := strings.Repeat(string(rune('a'+i)), 64)
+		writeStoreFile(t, filepath.Join(root, "images", name, "tags/1"), "linux/amd64 sha256:"+hex)
+		writeStoreFile(t, filepath.Join(root, "images", name, "manifests", hex, "manifest.json"), manifest)
+	}
+
+	want := []string{"ghcr.io/tags/app:1", "localhost:5000/app:1", "registry.example.com/nginx:1"}
+	for range 2 {
+		if listed := listedImages(t, cfg); !slices.Equal(listed, want) {
+			t.Errorf("listed %q, want %q", listed, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "images/docker.io")); !os.IsNotExist(err) {
+		t.Errorf("moved a repository to Docker Hub: %v", err)
+	}
+}
+
+func TestStoreMigratesOnce(t *testing.T) {
+	root := t.TempDir()
+	cfg := config.Config{RootDir: root}
+	writeStoreFile(t, filepath.Join(root, "images/nginx/tags/1"), "sha256:"+strings.Repeat("a", 64))
+	if listed := listedImages(t, cfg); !slices.Equal(listed, []string{"docker.io/library/nginx:1"}) {
+		t.Fatalf("listed %q", listed)
+	}
+
+	// a directory that looks like the old layout, once the store has a
+	// version, is left alone
+	stray := filepath.Join(root, "images/nginx/tags/2")
+	writeStoreFile(t, stray, "sha256:"+strings.Repeat("b", 64))
+	if listed := listedImages(t, cfg); !slices.Equal(listed, []string{"docker.io/library/nginx:1"}) {
+		t.Errorf("listed %q", listed)
+	}
+	if _, err := os.Stat(stray); err != nil {
+		t.Errorf("migrated again: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package runtime
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/harsha3330/crun/internal/config"
+	logger "github.com/harsha3330/crun/internal/log"
+	"github.com/harsha3330/crun/internal/pkg"
+)
+
+// Tag makes target another name for the pulled image source, for every
+// platform source was pulled for, replacing whatever target named before.
+// Blobs and layers are shared by the whole store, so only the manifests
+// are copied, and only when target is in another repository.
+func Tag(cfg config.Config, log *slog.Logger, stater logger.Console, source, target string) error {
+	src, err := parseImage(source)
+	if err != nil {
+		stater.Error(err.Error())
+		return err
+	}
+	dst, err := parseImage(target)
+	if err != nil {
+		stater.Error(err.Error())
+		return err
+	}
+	if dst.Digest != "" {
+		err := fmt.Errorf("cannot tag as %s: the target must be a tag", dst)
+		stater.Error(err.Error())
+		return err
+	}
+
+	// prune and rmi must not remove the manifests while they are copied
+	_, storeLock, err := lockStore(cfg, stater, false)
+	if err != nil {
+		return err
+	}
+	defer storeLock.Unlock()
+
+	refs, err := localManifests(cfg.RootDir, src)
+	if err != nil {
+		stater.Error("image not available locally", "image", src.String(), "error", err)
+		return err
+	}
+	if dst.Name() != src.Name() {
+		for _, r := range refs {
+			if err := copyManifest(cfg.RootDir, src.Name(), dst.Name(), r.Manifest); err != nil {
+				stater.Error("failed to copy the image manifest", "manifest", r.Manifest, "error", err)
+				return err
+			}
+		}
+	}
+	if err := writeRefFile(tagPath(cfg.RootDir, dst), refs); err != nil {
+		stater.Error("failed to save the tag", "error", err)
+		return err
+	}
+	log.Info("tagged image", "image", src.String(), "tag", dst.String(), "platforms", len(refs))
+	stater.Success("image tagged", "image", src.String(), "tag", dst.String())
+	return nil
+}
+
+// copyManifest stores the manifest digest of repository from under
+// repository to as well, with its pull metadata. A manifest already there
+// is left alone.
+func copyManifest(rootDir, from, to, digest string) error {
+	if _, err := os.Stat(manifestPath(rootDir, to, digest)); err == nil {
+		return nil
+	}
+	data, err := os.ReadFile(manifestPath(rootDir, from, digest))
+	if err != nil {
+		return err
+	}
+	if err := pkg.SaveFile(manifestPath(rootDir, to, digest), data); err != nil {
+		return err
+	}
+	meta, err := readMetadata(rootDir, from, digest)
+	if err != nil || meta == nil {
+		return err
+	}
+	return saveMetadata(rootDir, to, digest, *meta)
+}